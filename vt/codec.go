@@ -0,0 +1,164 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+import "io"
+
+const bufsz = 8 * Maxblock
+
+// Decoder reads venti calls from an io.Reader. The byte slices in the
+// decoded calls (Data, Crypto, Codec, Pkt) point to the Decoder's buffer.
+// The Decoder never overwrites data it has already returned, so they
+// stay valid after the following calls are decoded.
+type Decoder struct {
+	r      io.Reader
+	vers   int
+	maxsz  int
+	buf    []byte
+	pos    int // start of the data not decoded yet
+	end    int // end of the data read
+	nreads int
+}
+
+// Encoder writes venti calls to an io.Writer. The calls are buffered
+// until Flush is called, or there is no room for the next call.
+type Encoder struct {
+	w       io.Writer
+	vers    int
+	buf     []byte
+	pos     int
+	nwrites int
+}
+
+// Creates a Decoder for the specified protocol version.
+func NewDecoder(r io.Reader, vers int) *Decoder {
+	d := new(Decoder)
+	d.r = r
+	d.vers = vers
+	d.maxsz = MaxblockVersion(vers) + 64 // block and call header
+	d.buf = make([]byte, bufsz)
+
+	return d
+}
+
+// Reads the next call. Returns the error from the Reader, or Epacket if
+// the data read is not a valid call.
+func (d *Decoder) Decode(vc *Call) error {
+	hsz := hdrsize(d.vers)
+	for {
+		need := hsz
+		if d.end-d.pos >= hsz {
+			sz := Callsize(d.buf[d.pos:d.end], d.vers)
+			if sz > d.maxsz {
+				return Etoobig
+			}
+
+			if d.end-d.pos >= sz {
+				n, err := UnpackVersion(d.buf[d.pos:d.end], vc, d.vers)
+				if err != nil {
+					return err
+				} else if n == 0 {
+					return Epacket
+				}
+
+				d.pos += n
+				return nil
+			}
+
+			need = sz
+		}
+
+		if len(d.buf)-d.pos < need || len(d.buf)-d.end < Maxblock {
+			// get a new buffer, the old one may still be referenced
+			b := make([]byte, bufsz+need)
+			copy(b, d.buf[d.pos:d.end])
+			d.end -= d.pos
+			d.pos = 0
+			d.buf = b
+		}
+
+		n, err := d.r.Read(d.buf[d.end:])
+		d.nreads++
+		d.end += n
+		if n == 0 {
+			if err == nil {
+				err = io.ErrNoProgress
+			}
+
+			return err
+		}
+	}
+}
+
+// Returns the number of reads from the Reader.
+func (d *Decoder) Nreads() int {
+	return d.nreads
+}
+
+// Creates an Encoder for the specified protocol version.
+func NewEncoder(w io.Writer, vers int) *Encoder {
+	e := new(Encoder)
+	e.w = w
+	e.vers = vers
+	e.buf = make([]byte, bufsz)
+
+	return e
+}
+
+// Packs the call into the Encoder's buffer. If there is no room for it,
+// the buffered calls are written first. Returns Epacket if the call
+// can't be packed, or the error from the Writer. The Pkt field of the
+// call is valid until the next Encode or Flush.
+func (e *Encoder) Encode(vc *Call) error {
+	n := PackVersion(e.buf[e.pos:], vc, e.vers)
+	if n < 0 && e.pos > 0 {
+		err := e.Flush()
+		if err != nil {
+			return err
+		}
+
+		n = PackVersion(e.buf, vc, e.vers)
+	}
+
+	if n < 0 && len(e.buf) < bufsz+len(vc.Data) {
+		// a large block, make room for it
+		e.buf = make([]byte, bufsz+len(vc.Data))
+		n = PackVersion(e.buf, vc, e.vers)
+	}
+
+	if n < 0 {
+		return Epacket
+	}
+
+	e.pos += n
+	return nil
+}
+
+// Writes the buffered calls.
+func (e *Encoder) Flush() error {
+	b := e.buf[0:e.pos]
+	e.pos = 0
+	for len(b) > 0 {
+		n, err := e.w.Write(b)
+		e.nwrites++
+		if err != nil {
+			return err
+		}
+
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// Returns the number of bytes buffered.
+func (e *Encoder) Buffered() int {
+	return e.pos
+}
+
+// Returns the number of writes to the Writer.
+func (e *Encoder) Nwrites() int {
+	return e.nwrites
+}
@@ -0,0 +1,115 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+// Entry flags
+const (
+	EntryActive    = 1 << 0
+	EntryDir       = 1 << 1
+	EntryLocal     = 1 << 5
+	EntryNoArchive = 1 << 7
+
+	entryDepthShift = 2
+	entryDepthMask  = 7 << entryDepthShift
+)
+
+// Entry describes a hash tree stored on venti. Entries are packed
+// in DirBlocks, Entrysize bytes each.
+type Entry struct {
+	Gen   uint32 // generation number
+	Psize uint16 // pointer block size
+	Dsize uint16 // data block size
+	Flags uint8  // EntryActive, EntryDir, etc.
+	Depth uint8  // depth of the tree, 0 if Score points to a data block
+	Size  uint64 // size of the data, 48 bits
+	Score Score  // score of the tree's root block
+}
+
+var Eentry *Error = &Error{"invalid entry"}
+
+// Returns the block type of the root block of the hash tree.
+func (e *Entry) Type() uint8 {
+	if e.Flags&EntryDir != 0 {
+		return DirBlock + e.Depth
+	}
+
+	return DataBlock + e.Depth
+}
+
+// Packs the entry in buf. Returns the size of the packed entry,
+// or -1 if the buffer is too small.
+func PackEntry(buf []byte, e *Entry) int {
+	if len(buf) < Entrysize || e.Depth > entryDepthMask>>entryDepthShift {
+		return -1
+	}
+
+	flags := e.Flags &^ (EntryDir | entryDepthMask)
+	flags |= e.Depth << entryDepthShift
+	if e.Flags&EntryDir != 0 {
+		flags |= EntryDir
+	}
+
+	buf = Pint32(e.Gen, buf)
+	buf = Pint16(e.Psize, buf)
+	buf = Pint16(e.Dsize, buf)
+	buf = Pint8(flags, buf)
+	buf = Pint32(0, buf)
+	buf = Pint8(0, buf)
+	buf = Pint48(e.Size, buf)
+	Pscore(e.Score, buf)
+
+	return Entrysize
+}
+
+// Unpacks an entry from buf.
+func UnpackEntry(buf []byte, e *Entry) *Error {
+	if len(buf) < Entrysize {
+		return Eentry
+	}
+
+	e.Gen, buf = Gint32(buf)
+	e.Psize, buf = Gint16(buf)
+	e.Dsize, buf = Gint16(buf)
+	e.Flags, buf = Gint8(buf)
+	e.Depth = (e.Flags & entryDepthMask) >> entryDepthShift
+	e.Flags &^= entryDepthMask
+	buf = buf[5:]
+	e.Size, buf = Gint48(buf)
+	e.Score, _ = Gscore(buf)
+
+	return nil
+}
+
+// Packs the entries into the payload of a DirBlock.
+func PackEntries(es []Entry) []byte {
+	buf := make([]byte, len(es)*Entrysize)
+	for i := range es {
+		if PackEntry(buf[i*Entrysize:], &es[i]) < 0 {
+			return nil
+		}
+	}
+
+	return buf
+}
+
+// Splits the payload of a DirBlock into entries. The block may be
+// zero-truncated, trailing bytes that don't make up a whole entry are
+// zero-extended to one.
+func UnpackEntries(buf []byte) ([]Entry, *Error) {
+	n := (len(buf) + Entrysize - 1) / Entrysize
+	if len(buf)%Entrysize != 0 {
+		buf = ZeroExtend(DirBlock, buf[0:len(buf):len(buf)], n*Entrysize)
+	}
+
+	es := make([]Entry, n)
+	for i := range es {
+		err := UnpackEntry(buf[i*Entrysize:], &es[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return es, nil
+}
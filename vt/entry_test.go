@@ -0,0 +1,136 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+import (
+	"bytes"
+	"testing"
+)
+
+// An entry as packed by Plan 9's vtentrypack: an active directory tree
+// of depth 2 with 8K blocks.
+var entryBytes = []byte{
+	0x00, 0x00, 0x00, 0x07, // gen
+	0x20, 0x00, // psize
+	0x20, 0x00, // dsize
+	0x0b,                         // flags: active, dir, depth 2
+	0x00, 0x00, 0x00, 0x00, 0x00, // unused
+	0x00, 0x00, 0x01, 0x23, 0x45, 0x67, // size
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, // score
+	0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10, 0x11, 0x12, 0x13, 0x00,
+}
+
+var entry = Entry{
+	Gen:   7,
+	Psize: 8192,
+	Dsize: 8192,
+	Flags: EntryActive | EntryDir,
+	Depth: 2,
+	Size:  0x1234567,
+	Score: Score{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 0},
+}
+
+func TestPackEntry(t *testing.T) {
+	buf := make([]byte, Entrysize)
+	if n := PackEntry(buf, &entry); n != Entrysize {
+		t.Fatalf("PackEntry returned %d", n)
+	}
+
+	if !bytes.Equal(buf, entryBytes) {
+		t.Fatalf("packed entry\n%x\nexpected\n%x", buf, entryBytes)
+	}
+
+	if PackEntry(buf[0:Entrysize-1], &entry) != -1 {
+		t.Fatalf("PackEntry accepted a short buffer")
+	}
+
+	var e Entry
+	if err := UnpackEntry(entryBytes, &e); err != nil {
+		t.Fatalf("UnpackEntry: %v", err)
+	}
+
+	if e != entry {
+		t.Fatalf("unpacked %+v, expected %+v", e, entry)
+	}
+
+	if e.Type() != DirBlock+2 {
+		t.Fatalf("entry type %d", e.Type())
+	}
+
+	if UnpackEntry(entryBytes[0:Entrysize-1], &e) != Eentry {
+		t.Fatalf("UnpackEntry accepted a short buffer")
+	}
+}
+
+// The score of the last entry ends with a zero that is lost when the
+// DirBlock is zero-truncated.
+func TestUnpackEntriesTruncated(t *testing.T) {
+	e0 := entry
+	e0.Gen = 1
+	buf := PackEntries([]Entry{e0, entry})
+	buf = ZeroTruncate(DirBlock, buf)
+	if len(buf) != 2*Entrysize-1 {
+		t.Fatalf("truncated to %d bytes", len(buf))
+	}
+
+	es, err := UnpackEntries(buf)
+	if err != nil {
+		t.Fatalf("UnpackEntries: %v", err)
+	}
+
+	if len(es) != 2 || es[0] != e0 || es[1] != entry {
+		t.Fatalf("unpacked %+v", es)
+	}
+}
+
+// A root as packed by Plan 9's vtrootpack.
+func rootBytes() []byte {
+	buf := make([]byte, Rootsize)
+	buf[1] = RootVersion
+	copy(buf[2:], "vac")
+	copy(buf[2+rootStrsize:], "vac")
+	for i := 0; i < Scoresize; i++ {
+		buf[2+2*rootStrsize+i] = byte(i + 1)
+		buf[2+2*rootStrsize+Scoresize+2+i] = byte(0xff - i)
+	}
+
+	buf[2+2*rootStrsize+Scoresize] = 0x20
+	return buf
+}
+
+func TestPackRoot(t *testing.T) {
+	var r Root
+
+	rb := rootBytes()
+	if err := UnpackRoot(rb, &r); err != nil {
+		t.Fatalf("UnpackRoot: %v", err)
+	}
+
+	if r.Version != RootVersion || r.Name != "vac" || r.Type != "vac" || r.Blocksize != 8192 {
+		t.Fatalf("unpacked %+v", r)
+	}
+
+	if r.Score[0] != 1 || r.Score[Scoresize-1] != Scoresize || r.Prev[0] != 0xff || r.Prev[Scoresize-1] != 0xff-Scoresize+1 {
+		t.Fatalf("unpacked scores %v %v", r.Score, r.Prev)
+	}
+
+	buf := make([]byte, Rootsize)
+	if n := PackRoot(buf, &r); n != Rootsize {
+		t.Fatalf("PackRoot returned %d", n)
+	}
+
+	if !bytes.Equal(buf, rb) {
+		t.Fatalf("packed root\n%x\nexpected\n%x", buf, rb)
+	}
+
+	rb[1] = RootVersion + 1
+	if UnpackRoot(rb, &r) != Eroot {
+		t.Fatalf("UnpackRoot accepted version %d", rb[1])
+	}
+
+	if UnpackRoot(rb[0:Rootsize-1], &r) != Eroot {
+		t.Fatalf("UnpackRoot accepted a short buffer")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors with a well-known Rerror string. The errors returned for Rerror
+// messages with these strings can be matched with errors.Is.
+var (
+	ErrNotFound     *Error = &Error{"not found"}
+	ErrBadType      *Error = Eblktype
+	ErrTooBig       *Error = Etoobig
+	ErrReadOnly     *Error = &Error{"read only"}
+	ErrUnauthorized *Error = &Error{"unauthorized"}
+)
+
+var knownErrors = [...]*Error{
+	ErrNotFound,
+	ErrBadType,
+	ErrTooBig,
+	ErrReadOnly,
+	ErrUnauthorized,
+}
+
+// Messages used by other venti servers for the well-known errors.
+var errorPrefixes = [...]struct {
+	prefix string
+	err    *Error
+}{
+	{"no block with score", ErrNotFound}, // Plan 9 venti
+	{"read-only", ErrReadOnly},
+	{"permission denied", ErrUnauthorized},
+}
+
+// Errors match if their strings are the same.
+func (e Error) Is(target error) bool {
+	switch t := target.(type) {
+	case *Error:
+		return t != nil && t.Ename == e.Ename
+	case Error:
+		return t.Ename == e.Ename
+	}
+
+	return false
+}
+
+// Returns the error for the string received in Rerror. Well-known
+// messages are converted to the matching error value.
+func ParseError(ename string) *Error {
+	for _, e := range knownErrors {
+		if e.Ename == ename {
+			return e
+		}
+	}
+
+	for _, p := range errorPrefixes {
+		if strings.HasPrefix(ename, p.prefix) {
+			return p.err
+		}
+	}
+
+	return &Error{ename}
+}
+
+// Returns the string that should be sent in Rerror for the error.
+// Errors matching one of the well-known errors are converted to its
+// canonical string.
+func Ename(err error) string {
+	for _, e := range knownErrors {
+		if errors.Is(err, e) {
+			return e.Ename
+		}
+	}
+
+	return err.Error()
+}
+
+// Returns true if the block type is valid.
+func CheckType(btype uint8) bool {
+	return toDiskType(btype) != VtCorruptType
+}
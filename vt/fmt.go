@@ -8,13 +8,17 @@ import (
 	"fmt"
 )
 
+const hexdigits = "0123456789abcdef"
+
 func (s Score) String() string {
-	ret := ""
-	for i := 0; i < Scoresize; i++ {
-		ret = fmt.Sprintf("%s%02x", ret, s[i])
+	var buf [2 * Scoresize]byte
+
+	for i, b := range s {
+		buf[2*i] = hexdigits[b>>4]
+		buf[2*i+1] = hexdigits[b&0xF]
 	}
 
-	return ret
+	return string(buf[:])
 }
 
 func (c *Call) String() string {
@@ -0,0 +1,172 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+import (
+	"bytes"
+	"testing"
+)
+
+var fuzzids = [...]uint8{
+	Rerror, Tping, Rping, Thello, Rhello, Tgoodbye,
+	Tread, Rread, Twrite, Rwrite, Tsync, Rsync,
+}
+
+// Returns a call of each message type.
+func seedCalls() []*Call {
+	score := Score{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	data := []byte("some block data")
+
+	return []*Call{
+		{Id: Rerror, Tag: 1, Ename: "not found"},
+		{Id: Tping, Tag: 2},
+		{Id: Rping, Tag: 2},
+		{Id: Thello, Tag: 3, Version: "04", Uid: "anonymous", Crypto: []byte{}, Codec: []byte{}},
+		{Id: Rhello, Tag: 3, Sid: "govt", Rcrypto: 1, Rcodec: 2},
+		{Id: Tgoodbye, Tag: 4},
+		{Id: Tread, Tag: 5, Score: score, Btype: DataBlock + 1, Count: 8192},
+		{Id: Rread, Tag: 5, Data: data},
+		{Id: Twrite, Tag: 6, Btype: DirBlock, Data: data},
+		{Id: Rwrite, Tag: 6, Score: score},
+		{Id: Tsync, Tag: 7},
+		{Id: Rsync, Tag: 7},
+	}
+}
+
+// Unpacks random data as a call using both protocol versions. Calls that
+// unpack successfully are packed and unpacked again, and the result is
+// compared with the original.
+func FuzzUnpack(f *testing.F) {
+	for _, vc := range seedCalls() {
+		for _, vers := range []int{Version02, Version04} {
+			buf := make([]byte, 1024)
+			n := PackVersion(buf, vc, vers)
+			if n < 0 {
+				f.Fatalf("can't pack %v", vc)
+			}
+
+			f.Add(buf[0:n])
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, vers := range []int{Version02, Version04} {
+			var vc Call
+
+			n, err := UnpackVersion(data, &vc, vers)
+			if err != nil || n == 0 {
+				continue
+			}
+
+			roundtrip(t, &vc, vers, true)
+		}
+	})
+}
+
+// Builds a call of each type from random data and checks that it
+// survives a Pack/Unpack round trip.
+func FuzzPack(f *testing.F) {
+	for i := range fuzzids {
+		f.Add([]byte{uint8(i), 1, 2, 3, 4, 5, DataBlock + 1, 32, 'd', 'a', 't', 'a'})
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var vc Call
+
+		if len(data) < 8 {
+			return
+		}
+
+		vers := Version02
+		if data[1]&1 != 0 {
+			vers = Version04
+		}
+
+		vc.Id = fuzzids[int(data[0])%len(fuzzids)]
+		vc.Tag = data[2]
+		vc.Strength = data[3]
+		vc.Rcrypto = data[4]
+		vc.Rcodec = data[5]
+		vc.Btype = data[6] % (RBlock + 1)
+		vc.Count = uint32(data[7]) << 8
+		data = data[8:]
+
+		h := len(data) / 2
+		vc.Ename = string(data)
+		vc.Version = string(data[0:h])
+		vc.Uid = string(data[h:])
+		vc.Sid = string(data[h:])
+		vc.Crypto = data[0:h]
+		vc.Codec = data[h:]
+		vc.Data = data
+		copy(vc.Score[:], data)
+
+		roundtrip(t, &vc, vers, false)
+	})
+}
+
+// Packs the call, unpacks the result and compares it with the original.
+// If mustpack is true, failing to pack the call is an error.
+func roundtrip(t *testing.T, vc *Call, vers int, mustpack bool) {
+	var vc2 Call
+
+	buf := make([]byte, len(vc.Pkt)+len(vc.Data)+len(vc.Ename)+len(vc.Version)+
+		len(vc.Uid)+len(vc.Sid)+len(vc.Crypto)+len(vc.Codec)+64)
+	n := PackVersion(buf, vc, vers)
+	if n < 0 {
+		if mustpack {
+			t.Fatalf("can't pack an unpacked call: %v", vc)
+		}
+
+		return
+	}
+
+	m, err := UnpackVersion(buf[0:n], &vc2, vers)
+	if err != nil {
+		t.Fatalf("can't unpack a packed call: %v", err)
+	}
+
+	if m != n {
+		t.Fatalf("unpacked size %d differs from packed size %d", m, n)
+	}
+
+	if !eqcall(vc, &vc2) {
+		t.Fatalf("round trip mismatch: %v %v", vc, &vc2)
+	}
+}
+
+func eqcall(a, b *Call) bool {
+	if a.Id != b.Id || a.Tag != b.Tag {
+		return false
+	}
+
+	switch a.Id {
+	case Rerror:
+		return a.Ename == b.Ename
+
+	case Thello:
+		return a.Version == b.Version && a.Uid == b.Uid && a.Strength == b.Strength &&
+			bytes.Equal(a.Crypto, b.Crypto) && bytes.Equal(a.Codec, b.Codec)
+
+	case Rhello:
+		return a.Sid == b.Sid && a.Rcrypto == b.Rcrypto && a.Rcodec == b.Rcodec
+
+	case Tread:
+		// pointer types of data and dir blocks share the disk type
+		return a.Score == b.Score && toDiskType(a.Btype) == toDiskType(b.Btype) &&
+			a.Count == b.Count
+
+	case Rread:
+		return bytes.Equal(a.Data, b.Data)
+
+	case Twrite:
+		return toDiskType(a.Btype) == toDiskType(b.Btype) && bytes.Equal(a.Data, b.Data)
+
+	case Rwrite:
+		return a.Score == b.Score
+	}
+
+	return true
+}
@@ -65,9 +65,11 @@ var fromdisk = [...]uint8{
 
 var Epacket *Error = &Error{"invalid packet"}
 var Eblktype *Error = &Error{"invalid block type"}
+var Etoobig *Error = &Error{"block too big"}
+var Eversion *Error = &Error{"unsupported protocol version"}
 
 func fromDiskType(val uint8) uint8 {
-	if int(val) > len(fromdisk) {
+	if int(val) >= len(fromdisk) {
 		return VtCorruptType
 	}
 
@@ -75,20 +77,58 @@ func fromDiskType(val uint8) uint8 {
 }
 
 func toDiskType(val uint8) uint8 {
-	if int(val) > len(todisk) {
+	if int(val) >= len(todisk) {
 		return VtCorruptType
 	}
 
 	return todisk[val]
 }
 
+// Returns the size of the message header for the protocol version.
+func hdrsize(vers int) int {
+	if vers == Version04 {
+		return 4 + 1 + 1 // size[4] id[1] tag[1]
+	}
+
+	return 2 + 1 + 1 // size[2] id[1] tag[1]
+}
+
+// Returns the size of the call starting at the beginning of the buffer,
+// or -1 if the buffer doesn't contain the whole size field.
+func Callsize(buf []byte, vers int) int {
+	if vers == Version04 {
+		if len(buf) < 4 {
+			return -1
+		}
+
+		sz, _ := Gint32(buf)
+		return int(sz) + 4
+	}
+
+	if len(buf) < 2 {
+		return -1
+	}
+
+	sz, _ := Gint16(buf)
+	return int(sz) + 2
+}
+
 func PackCall(buf []byte, id uint8, tag uint8, size int) (int, []byte) {
-	size += 2 + 1 + 1 // size[2] id[1] tag[1]
-	if len(buf) < size {
+	return packCall(buf, Version02, id, tag, size)
+}
+
+func packCall(buf []byte, vers int, id uint8, tag uint8, size int) (int, []byte) {
+	hsz := hdrsize(vers)
+	size += hsz
+	if len(buf) < size || (vers != Version04 && size-2 > 0xFFFF) {
 		return -1, nil
 	}
 
-	buf = Pint16(uint16(size-2), buf)
+	if vers == Version04 {
+		buf = Pint32(uint32(size-4), buf)
+	} else {
+		buf = Pint16(uint16(size-2), buf)
+	}
 	buf = Pint8(id, buf)
 	buf = Pint8(tag, buf)
 
@@ -96,7 +136,11 @@ func PackCall(buf []byte, id uint8, tag uint8, size int) (int, []byte) {
 }
 
 func PackEmpty(buf []byte, id, tag uint8) int {
-	sz, buf := PackCall(buf, id, tag, 0)
+	return packEmpty(buf, Version02, id, tag)
+}
+
+func packEmpty(buf []byte, vers int, id, tag uint8) int {
+	sz, buf := packCall(buf, vers, id, tag, 0)
 	if buf == nil {
 		return -1
 	}
@@ -109,7 +153,15 @@ func PackTping(buf []byte, tag uint8) int {
 }
 
 func PackThello(buf []byte, tag uint8, version, uid string, strength uint8, crypto, codec []byte) int {
-	sz, buf := PackCall(buf, Thello, tag,
+	return packThello(buf, Version02, tag, version, uid, strength, crypto, codec)
+}
+
+func packThello(buf []byte, vers int, tag uint8, version, uid string, strength uint8, crypto, codec []byte) int {
+	if len(version) > 0xFFFF || len(uid) > 0xFFFF || len(crypto) > 0xFF || len(codec) > 0xFF {
+		return -1
+	}
+
+	sz, buf := packCall(buf, vers, Thello, tag,
 		7+len(version)+len(uid)+len(crypto)+len(codec)) // vesion[s] uid[s] strength[1] crypto[n] codec[n]
 	if buf == nil {
 		return -1
@@ -129,26 +181,55 @@ func PackTgoodbye(buf []byte, tag uint8) int {
 }
 
 func PackTread(buf []byte, tag uint8, score Score, btype uint8, count uint16) int {
-	sz, buf := PackCall(buf, Tread, tag, Scoresize+1+1+2) // score[20] type[1] pad[1] count[2]
+	return packTread(buf, Version02, tag, score, btype, uint32(count))
+}
+
+func packTread(buf []byte, vers int, tag uint8, score Score, btype uint8, count uint32) int {
+	csz := 2
+	if vers == Version04 {
+		csz = 4
+	} else if count > 0xFFFF {
+		return -1
+	}
+
+	sz, buf := packCall(buf, vers, Tread, tag, Scoresize+1+1+csz) // score[20] type[1] pad[1] count[2 or 4]
 	if buf == nil {
 		return -1
 	}
 
 	buf = Pscore(score, buf)
-	buf = Pint8(toDiskType(btype), buf)
+	dtype := toDiskType(btype)
+	if dtype == VtCorruptType {
+		return -1
+	}
+
+	buf = Pint8(dtype, buf)
 	buf = Pint8(0, buf)
-	Pint16(count, buf)
+	if vers == Version04 {
+		Pint32(count, buf)
+	} else {
+		Pint16(uint16(count), buf)
+	}
 
 	return sz
 }
 
 func PackTwrite(buf []byte, tag uint8, btype uint8, data []byte) int {
-	sz, buf := PackCall(buf, Twrite, tag, 1+3+len(data)) // type[1] pad[3] data
+	return packTwrite(buf, Version02, tag, btype, data)
+}
+
+func packTwrite(buf []byte, vers int, tag uint8, btype uint8, data []byte) int {
+	dtype := toDiskType(btype)
+	if dtype == VtCorruptType {
+		return -1
+	}
+
+	sz, buf := packCall(buf, vers, Twrite, tag, 1+3+len(data)) // type[1] pad[3] data
 	if buf == nil {
 		return -1
 	}
 
-	buf = Pint8(toDiskType(btype), buf)
+	buf = Pint8(dtype, buf)
 	buf = Pint8(0, buf)
 	buf = Pint16(0, buf)
 	copy(buf, data)
@@ -161,7 +242,15 @@ func PackTsync(buf []byte, tag uint8) int {
 }
 
 func PackRerror(buf []byte, tag uint8, ename string) int {
-	sz, buf := PackCall(buf, Rerror, tag, len(ename)+2)
+	return packRerror(buf, Version02, tag, ename)
+}
+
+func packRerror(buf []byte, vers int, tag uint8, ename string) int {
+	if len(ename) > 0xFFFF {
+		return -1
+	}
+
+	sz, buf := packCall(buf, vers, Rerror, tag, len(ename)+2)
 	if buf == nil {
 		return -1
 	}
@@ -175,7 +264,15 @@ func PackRping(buf []byte, tag uint8) int {
 }
 
 func PackRhello(buf []byte, tag uint8, sid string, rcrypto, rcodec uint8) int {
-	sz, buf := PackCall(buf, Rhello, tag, len(sid)+4)
+	return packRhello(buf, Version02, tag, sid, rcrypto, rcodec)
+}
+
+func packRhello(buf []byte, vers int, tag uint8, sid string, rcrypto, rcodec uint8) int {
+	if len(sid) > 0xFFFF {
+		return -1
+	}
+
+	sz, buf := packCall(buf, vers, Rhello, tag, len(sid)+4)
 	if buf == nil {
 		return -1
 	}
@@ -188,7 +285,11 @@ func PackRhello(buf []byte, tag uint8, sid string, rcrypto, rcodec uint8) int {
 }
 
 func PackRread(buf []byte, tag uint8, data []byte) int {
-	sz, buf := PackCall(buf, Rread, tag, len(data))
+	return packRread(buf, Version02, tag, data)
+}
+
+func packRread(buf []byte, vers int, tag uint8, data []byte) int {
+	sz, buf := packCall(buf, vers, Rread, tag, len(data))
 	if buf == nil {
 		return -1
 	}
@@ -200,7 +301,11 @@ func PackRread(buf []byte, tag uint8, data []byte) int {
 }
 
 func PackRwrite(buf []byte, tag uint8, score Score) int {
-	sz, buf := PackCall(buf, Rwrite, tag, Scoresize)
+	return packRwrite(buf, Version02, tag, score)
+}
+
+func packRwrite(buf []byte, vers int, tag uint8, score Score) int {
+	sz, buf := packCall(buf, vers, Rwrite, tag, Scoresize)
 	if buf == nil {
 		return -1
 	}
@@ -213,46 +318,40 @@ func PackRsync(buf []byte, tag uint8) int {
 	return PackEmpty(buf, Rsync, tag)
 }
 
+// Packs the call using the version 02 format.
 func Pack(buf []byte, vc *Call) int {
+	return PackVersion(buf, vc, Version02)
+}
+
+// Packs the call using the format of the specified protocol version.
+func PackVersion(buf []byte, vc *Call, vers int) int {
 	tag := vc.Tag
 
 	sz := -1
 	switch vc.Id {
 	case Rerror:
-		sz = PackRerror(buf, tag, vc.Ename)
+		sz = packRerror(buf, vers, tag, vc.Ename)
 
-	case Tping:
-		sz = PackTping(buf, tag)
-
-	case Rping:
-		sz = PackRping(buf, tag)
+	case Tping, Rping, Tgoodbye, Tsync, Rsync:
+		sz = packEmpty(buf, vers, vc.Id, tag)
 
 	case Thello:
-		sz = PackThello(buf, tag, vc.Version, vc.Uid, vc.Strength, vc.Crypto, vc.Codec)
+		sz = packThello(buf, vers, tag, vc.Version, vc.Uid, vc.Strength, vc.Crypto, vc.Codec)
 
 	case Rhello:
-		sz = PackRhello(buf, tag, vc.Sid, vc.Rcrypto, vc.Rcodec)
-
-	case Tgoodbye:
-		sz = PackTgoodbye(buf, tag)
+		sz = packRhello(buf, vers, tag, vc.Sid, vc.Rcrypto, vc.Rcodec)
 
 	case Tread:
-		sz = PackTread(buf, tag, vc.Score, vc.Btype, vc.Count)
+		sz = packTread(buf, vers, tag, vc.Score, vc.Btype, vc.Count)
 
 	case Rread:
-		sz = PackRread(buf, tag, vc.Data)
+		sz = packRread(buf, vers, tag, vc.Data)
 
 	case Twrite:
-		sz = PackTwrite(buf, tag, vc.Btype, vc.Data)
+		sz = packTwrite(buf, vers, tag, vc.Btype, vc.Data)
 
 	case Rwrite:
-		sz = PackRwrite(buf, tag, vc.Score)
-
-	case Tsync:
-		sz = PackTsync(buf, tag)
-
-	case Rsync:
-		sz = PackRsync(buf, tag)
+		sz = packRwrite(buf, vers, tag, vc.Score)
 	}
 
 	if sz > 0 {
@@ -262,24 +361,42 @@ func Pack(buf []byte, vc *Call) int {
 	return sz
 }
 
+// Unpacks a call in the version 02 format.
 func Unpack(buf []byte, vc *Call) (int, *Error) {
-	var sz uint16
+	return UnpackVersion(buf, vc, Version02)
+}
+
+// Unpacks a call in the format of the specified protocol version. Returns
+// 0 and no error if the buffer doesn't contain the whole call. Like
+// plan9port's libventi, version 04 accepts Tread calls with either a
+// 2 or a 4 byte count, whichever fits the size of the message.
+func UnpackVersion(buf []byte, vc *Call, vers int) (int, *Error) {
+	var sz uint32
 
-	if len(buf) < 4 {
+	hsz := hdrsize(vers)
+	if len(buf) < hsz {
 		return 0, nil
 	}
 
 	vc.Pkt = buf
-	sz, buf = Gint16(buf)
-	if (int(sz)) > len(buf) {
+	if vers == Version04 {
+		sz, buf = Gint32(buf)
+	} else {
+		var sz16 uint16
+
+		sz16, buf = Gint16(buf)
+		sz = uint32(sz16)
+	}
+
+	if uint64(sz) > uint64(len(buf)) {
 		return 0, nil
 	}
 
-	vc.Pkt = vc.Pkt[0 : sz+2]
+	psz := int(sz) + hsz - 2
+	vc.Pkt = vc.Pkt[0:psz]
 	buf = buf[0:sz]
 	vc.Id, buf = Gint8(buf)
 	vc.Tag, buf = Gint8(buf)
-
 	switch vc.Id {
 	default:
 		return 0, Epacket
@@ -314,14 +431,20 @@ func Unpack(buf []byte, vc *Call) (int, *Error) {
 		}
 
 		vc.Btype, buf = Gint8(buf)
-		n := fromDiskType(vc.Btype)
-		if n < 0 {
+		vc.Btype = fromDiskType(vc.Btype)
+		if vc.Btype == VtCorruptType {
 			return 0, Eblktype
 		}
-		vc.Btype = uint8(n)
 
 		_, buf = Gint8(buf)
-		vc.Count, buf = Gint16(buf)
+		if vers == Version04 && len(buf) == 4 {
+			vc.Count, buf = Gint32(buf)
+		} else {
+			var count uint16
+
+			count, buf = Gint16(buf)
+			vc.Count = uint32(count)
+		}
 
 	case Rread:
 		vc.Data = buf
@@ -333,11 +456,11 @@ func Unpack(buf []byte, vc *Call) (int, *Error) {
 		}
 
 		vc.Btype, buf = Gint8(buf)
-		n := fromDiskType(vc.Btype)
-		if n < 0 {
+		vc.Btype = fromDiskType(vc.Btype)
+		if vc.Btype == VtCorruptType {
 			return 0, Eblktype
 		}
-		vc.Btype = uint8(n)
+
 		vc.Data = buf[3:]
 		buf = buf[len(buf):]
 
@@ -356,5 +479,5 @@ func Unpack(buf []byte, vc *Call) (int, *Error) {
 		return 0, Epacket
 	}
 
-	return int(sz + 2), nil
+	return psz, nil
 }
@@ -0,0 +1,36 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+import "testing"
+
+// Version 04 Treads with a 2 or a 4 byte count, as sent by plan9port.
+func TestUnpackTreadCount(t *testing.T) {
+	score := Score{1, 2, 3}
+	for _, count := range [][]byte{{0x20, 0x00}, {0x00, 0x00, 0x20, 0x00}} {
+		buf := []byte{0, 0, 0, byte(2 + Scoresize + 2 + len(count)), Tread, 9}
+		buf = append(buf, score[:]...)
+		buf = append(buf, toDiskType(DataBlock), 0)
+		buf = append(buf, count...)
+
+		var vc Call
+		n, err := UnpackVersion(buf, &vc, Version04)
+		if err != nil || n != len(buf) {
+			t.Fatalf("%d byte count: UnpackVersion returned %d, %v", len(count), n, err)
+		}
+
+		if vc.Id != Tread || vc.Tag != 9 || vc.Score != score || vc.Btype != DataBlock || vc.Count != 8192 {
+			t.Errorf("%d byte count: unpacked %v", len(count), &vc)
+		}
+	}
+
+	buf := []byte{0, 0, 0, 2 + Scoresize + 2 + 3, Tread, 9}
+	buf = append(buf, score[:]...)
+	buf = append(buf, toDiskType(DataBlock), 0, 0x20, 0, 0)
+	var vc Call
+	if _, err := UnpackVersion(buf, &vc, Version04); err != Epacket {
+		t.Errorf("3 byte count: UnpackVersion returned %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+const (
+	Rootsize    = 300
+	RootVersion = 2
+	rootStrsize = 128
+)
+
+// Root is the content of an RBlock. It is used by vac and fossil to
+// name an archive.
+type Root struct {
+	Version   uint16
+	Name      string // at most 127 bytes
+	Type      string // at most 127 bytes
+	Score     Score  // score of the root DirBlock
+	Blocksize uint16 // maximum block size
+	Prev      Score  // score of the previous root block
+}
+
+var Eroot *Error = &Error{"invalid root block"}
+
+func prootstr(val string, buf []byte) []byte {
+	n := copy(buf[0:rootStrsize-1], val)
+	for ; n < rootStrsize; n++ {
+		buf[n] = 0
+	}
+
+	return buf[rootStrsize:]
+}
+
+func grootstr(buf []byte) (string, []byte) {
+	n := 0
+	for n < rootStrsize-1 && buf[n] != 0 {
+		n++
+	}
+
+	return string(buf[0:n]), buf[rootStrsize:]
+}
+
+// Packs the root in buf. Returns the size of the packed root,
+// or -1 if the buffer is too small.
+func PackRoot(buf []byte, r *Root) int {
+	if len(buf) < Rootsize {
+		return -1
+	}
+
+	vers := r.Version
+	if vers == 0 {
+		vers = RootVersion
+	}
+
+	buf = Pint16(vers, buf)
+	buf = prootstr(r.Name, buf)
+	buf = prootstr(r.Type, buf)
+	buf = Pscore(r.Score, buf)
+	buf = Pint16(r.Blocksize, buf)
+	Pscore(r.Prev, buf)
+
+	return Rootsize
+}
+
+// Unpacks a root from the content of an RBlock.
+func UnpackRoot(buf []byte, r *Root) *Error {
+	if len(buf) < Rootsize {
+		return Eroot
+	}
+
+	r.Version, buf = Gint16(buf)
+	if r.Version != RootVersion {
+		return Eroot
+	}
+
+	r.Name, buf = grootstr(buf)
+	r.Type, buf = grootstr(buf)
+	r.Score, buf = Gscore(buf)
+	r.Blocksize, buf = Gint16(buf)
+	r.Prev, _ = Gscore(buf)
+
+	return nil
+}
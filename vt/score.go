@@ -0,0 +1,46 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+import "encoding/hex"
+
+var Escore *Error = &Error{"invalid score"}
+
+// Parses a score from its hexadecimal representation.
+func ParseScore(s string) (Score, error) {
+	var score Score
+
+	err := score.UnmarshalText([]byte(s))
+	return score, err
+}
+
+func (s Score) Equal(s1 Score) bool {
+	return s == s1
+}
+
+// Returns true if the score is the score of the empty block (Zeroscore).
+func (s Score) IsZero() bool {
+	return s == Zeroscore
+}
+
+func (s Score) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Score) UnmarshalText(text []byte) error {
+	var score Score
+
+	if len(text) != 2*Scoresize {
+		return Escore
+	}
+
+	_, err := hex.Decode(score[:], text)
+	if err != nil {
+		return Escore
+	}
+
+	*s = score
+	return nil
+}
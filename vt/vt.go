@@ -4,7 +4,10 @@
 
 package vt
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 // Venti messages
 const (
@@ -22,11 +25,18 @@ const (
 	Rsync    = 17
 )
 
+// Protocol versions
+const (
+	Version02 = 2
+	Version04 = 4 // 32-bit message sizes
+)
+
 // Other constants
 const (
-	Scoresize = 20
-	Entrysize = 40
-	Maxblock  = 56 * 1024
+	Scoresize  = 20
+	Entrysize  = 40
+	Maxblock   = 56 * 1024        // version 02
+	Maxblock04 = 16 * 1024 * 1024 // version 04
 )
 
 // Block type
@@ -50,13 +60,16 @@ type Call struct {
 	Rcodec   byte   // Rhello
 	Score    Score  // Tread, Rwrite
 	Btype    byte   // Tread, Rwrite
-	Count    uint16 // Tread
+	Count    uint32 // Tread
 	Data     []byte // Twrite, Rread
 
 	Pkt []byte
 }
 
-type Score []byte
+// Score is the SHA-1 hash of a block's content. Scores are comparable and
+// can be used as map keys.
+type Score [Scoresize]byte
+
 type Error struct {
 	Ename string
 }
@@ -70,27 +83,54 @@ var Zeroscore = Score{
 	0xbf, 0xef, 0x95, 0x60, 0x18, 0x90, 0xaf, 0xd8, 0x07, 0x09,
 }
 
-var Banner string = "venti-02-govt\n"
+var Banner string = "venti-02:04-govt\n"
+
+// The G* functions return the value and the rest of the buffer. If the
+// buffer is too short, they return zero value and nil buffer. Passing
+// a nil buffer is allowed, so the calls can be chained and the result
+// checked only at the end.
+
+func Gint8(buf []byte) (uint8, []byte) {
+	if len(buf) < 1 {
+		return 0, nil
+	}
 
-func Gint8(buf []byte) (uint8, []byte) { return buf[0], buf[1:len(buf)] }
+	return buf[0], buf[1:len(buf)]
+}
 
 func Gint16(buf []byte) (uint16, []byte) {
+	if len(buf) < 2 {
+		return 0, nil
+	}
+
 	return uint16(buf[1]) | (uint16(buf[0]) << 8), buf[2:len(buf)]
 }
 
 func Gint32(buf []byte) (uint32, []byte) {
+	if len(buf) < 4 {
+		return 0, nil
+	}
+
 	return uint32(buf[3]) | (uint32(buf[2]) << 8) | (uint32(buf[1]) << 16) |
 			(uint32(buf[0]) << 24),
 		buf[4:len(buf)]
 }
 
 func Gint48(buf []byte) (uint64, []byte) {
+	if len(buf) < 6 {
+		return 0, nil
+	}
+
 	return uint64(buf[5]) | (uint64(buf[4]) << 8) | (uint64(buf[3]) << 16) |
 			uint64(buf[2])<<24 | (uint64(buf[1]) << 32) | (uint64(buf[0]) << 40),
 		buf[6:len(buf)]
 }
 
 func Gint64(buf []byte) (uint64, []byte) {
+	if len(buf) < 8 {
+		return 0, nil
+	}
+
 	return uint64(buf[7]) | (uint64(buf[6]) << 8) | (uint64(buf[5]) << 16) |
 			(uint64(buf[4]) << 24) | (uint64(buf[3]) << 32) | (uint64(buf[2]) << 40) |
 			(uint64(buf[1]) << 48) | (uint64(buf[0]) << 56),
@@ -105,7 +145,7 @@ func Gstr(buf []byte) (string, []byte) {
 	}
 
 	n, buf = Gint16(buf)
-	if int(n) > len(buf) {
+	if buf == nil || int(n) > len(buf) {
 		return "", nil
 	}
 
@@ -120,19 +160,22 @@ func Gvar(buf []byte) ([]byte, []byte) {
 	}
 
 	n, buf = Gint8(buf)
-	if int(n) > len(buf) {
+	if buf == nil || int(n) > len(buf) {
 		return nil, nil
 	}
 
 	return buf[0:n], buf[n:len(buf)]
 }
 
-func Gscore(buf []byte) ([]byte, []byte) {
+func Gscore(buf []byte) (Score, []byte) {
+	var s Score
+
 	if len(buf) < Scoresize {
-		return nil, nil
+		return s, nil
 	}
 
-	return buf[0:Scoresize], buf[Scoresize:]
+	copy(s[:], buf)
+	return s, buf[Scoresize:]
 }
 
 func Pint8(val uint8, buf []byte) []byte {
@@ -193,7 +236,7 @@ func Pvar(val []byte, buf []byte) []byte {
 }
 
 func Pscore(val Score, buf []byte) []byte {
-	copy(buf, val)
+	copy(buf, val[:])
 	return buf[Scoresize:]
 }
 
@@ -201,27 +244,60 @@ func (c *Call) Clear() {
 	c.Id = 0
 	c.Crypto = nil
 	c.Codec = nil
-	c.Score = nil
+	c.Score = Score{}
 	c.Data = nil
 	c.Pkt = nil
 }
 
-func CheckBanner(banner string) bool {
+// Returns the maximum block size for the protocol version.
+func MaxblockVersion(vers int) int {
+	if vers == Version04 {
+		return Maxblock04
+	}
+
+	return Maxblock
+}
+
+// Returns the string used in Thello for the protocol version.
+func VersionString(vers int) string {
+	return fmt.Sprintf("%02d", vers)
+}
+
+func bannerVersions(banner string) []string {
 	if !strings.HasPrefix(banner, "venti-") {
-		return false
+		return nil
 	}
 
 	ds := strings.SplitN(banner, "-", 3)
 	if len(ds) < 3 || ds[0] != "venti" {
-		return false
+		return nil
 	}
 
-	vs := strings.SplitN(ds[1], ":", -1)
-	for i := 0; i < len(vs); i++ {
-		if vs[i] == "02" {
-			return true
+	return strings.SplitN(ds[1], ":", -1)
+}
+
+// Returns the highest protocol version listed both in the peer's banner
+// and in Banner, or 0 if there is none.
+func BannerVersion(banner string) int {
+	vers := 0
+	ours := bannerVersions(Banner)
+	for _, v := range bannerVersions(banner) {
+		for _, w := range ours {
+			if v != w {
+				continue
+			}
+
+			if v == "02" && vers < Version02 {
+				vers = Version02
+			} else if v == "04" {
+				vers = Version04
+			}
 		}
 	}
 
-	return false
+	return vers
+}
+
+func CheckBanner(banner string) bool {
+	return BannerVersion(banner) != 0
 }
@@ -0,0 +1,261 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mischief/govt/vt"
+)
+
+// Cache keeps the most recently used blocks in memory. Blocks never
+// change, so they can be cached without invalidation. A Cache can be
+// shared by several clients.
+type Cache struct {
+	sync.Mutex
+	maxsize int    // maximum size of the cached data
+	size    int    // current size of the cached data
+	dir     string // directory the cache is saved to
+	lru     *list.List
+	blocks  map[cacheKey]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+type cacheKey struct {
+	score vt.Score
+	btype uint8
+}
+
+type cacheBlock struct {
+	key  cacheKey
+	data []byte
+}
+
+// Creates a Cache holding up to maxsize bytes of data.
+func NewCache(maxsize int) *Cache {
+	c := new(Cache)
+	c.maxsize = maxsize
+	c.lru = list.New()
+	c.blocks = make(map[cacheKey]*list.Element)
+
+	return c
+}
+
+// Creates a Cache that can be saved to dir, and loads the blocks saved
+// there before. The directory is created if it doesn't exist.
+func OpenCache(dir string, maxsize int) (*Cache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type saved struct {
+		name  string
+		mtime int64
+	}
+
+	var blks []saved
+	for _, f := range files {
+		fi, err := f.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		blks = append(blks, saved{f.Name(), fi.ModTime().UnixNano()})
+	}
+
+	// load the oldest first, so they are the first to go
+	sort.Slice(blks, func(i, j int) bool { return blks[i].mtime < blks[j].mtime })
+
+	c := NewCache(maxsize)
+	c.dir = dir
+	for _, b := range blks {
+		key, ok := parseCacheName(b.name)
+		if !ok {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, b.name))
+		if err != nil || !checkScore(key.score, key.btype, data) {
+			// corrupt, don't trust it
+			os.Remove(filepath.Join(dir, b.name))
+			continue
+		}
+
+		c.Put(key.score, key.btype, data)
+	}
+
+	return c, nil
+}
+
+func cacheName(key cacheKey) string {
+	return fmt.Sprintf("%v.%d", key.score, key.btype)
+}
+
+func parseCacheName(name string) (key cacheKey, ok bool) {
+	s, t, found := strings.Cut(name, ".")
+	if !found {
+		return key, false
+	}
+
+	n, err := strconv.ParseUint(t, 10, 8)
+	if err != nil {
+		return key, false
+	}
+
+	key.score, err = vt.ParseScore(s)
+	key.btype = uint8(n)
+	return key, err == nil && cacheName(key) == name
+}
+
+// Returns the cached block. The returned data is a copy.
+func (c *Cache) Get(score vt.Score, btype uint8) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.blocks[cacheKey{score, btype}]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	c.lru.MoveToFront(e)
+	b := e.Value.(*cacheBlock)
+	data := make([]byte, len(b.data))
+	copy(data, b.data)
+
+	return data, true
+}
+
+// Adds a copy of the block to the cache, removing the least recently
+// used blocks if there is not enough room.
+func (c *Cache) Put(score vt.Score, btype uint8, data []byte) {
+	if len(data) > c.maxsize {
+		return
+	}
+
+	key := cacheKey{score, btype}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.blocks[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	b := &cacheBlock{key, make([]byte, len(data))}
+	copy(b.data, data)
+	c.blocks[key] = c.lru.PushFront(b)
+	c.size += len(data)
+	for c.size > c.maxsize {
+		e := c.lru.Back()
+		old := c.lru.Remove(e).(*cacheBlock)
+		delete(c.blocks, old.key)
+		c.size -= len(old.data)
+	}
+}
+
+// Sets the cache used by the client. The blocks read are added to the
+// cache after their scores are checked. A nil cache disables caching.
+func (clnt *Clnt) SetCache(c *Cache) {
+	clnt.Lock()
+	clnt.cache = c
+	clnt.Unlock()
+}
+
+func (clnt *Clnt) getCache() *Cache {
+	clnt.Lock()
+	defer clnt.Unlock()
+
+	return clnt.cache
+}
+
+// Returns the number of cache hits and misses.
+func (c *Cache) Stats() (hits, misses uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.hits, c.misses
+}
+
+// Returns the size of the cached data.
+func (c *Cache) Size() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.size
+}
+
+// Writes the cached blocks to the directory specified in OpenCache, and
+// removes the blocks that are no longer cached from it. The blocks are
+// loaded again by the next OpenCache.
+func (c *Cache) Save() error {
+	if c.dir == "" {
+		return &vt.Error{"cache has no directory"}
+	}
+
+	c.Lock()
+	names := make(map[string]bool, len(c.blocks))
+	blks := make([]*cacheBlock, 0, len(c.blocks))
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		b := e.Value.(*cacheBlock)
+		names[cacheName(b.key)] = true
+		blks = append(blks, b)
+	}
+	c.Unlock()
+
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	have := make(map[string]bool, len(files))
+	for _, f := range files {
+		if names[f.Name()] {
+			have[f.Name()] = true
+		} else if _, ok := parseCacheName(f.Name()); ok {
+			os.Remove(filepath.Join(c.dir, f.Name()))
+		}
+	}
+
+	// oldest first, so the modification times keep the LRU order
+	for _, b := range blks {
+		name := filepath.Join(c.dir, cacheName(b.key))
+		if have[cacheName(b.key)] {
+			now := time.Now()
+			os.Chtimes(name, now, now)
+			continue
+		}
+
+		tmp := name + ".tmp"
+		err = os.WriteFile(tmp, b.data, 0644)
+		if err == nil {
+			err = os.Rename(tmp, name)
+		}
+
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	return nil
+}
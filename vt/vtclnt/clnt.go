@@ -5,12 +5,13 @@
 package vtclnt
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
-	"hash"
 	"log"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/mischief/govt/vt"
 )
@@ -32,6 +33,7 @@ type Clnt struct {
 	Debuglevel int
 	Id         string
 	Log        *vt.Logger
+	NoVerify   bool // don't check the scores of the blocks read
 
 	conn     net.Conn
 	tagpool  *pool
@@ -41,16 +43,41 @@ type Clnt struct {
 	reqlast  *Req
 	err      *vt.Error
 	reqchan  chan *Req
-	schan    chan hash.Hash
+	version  int
+	stale    map[uint8]*Req // cancelled requests waiting for a response
+	werr     *vt.Error      // first failed Put since the last Sync
+	cache    *Cache         // if not nil, blocks read and written are cached
+
+	reconnect *Reconnect
+	dial      dialFunc
+	closing   bool          // Hangup was called
+	hangup    chan struct{} // closed when Hangup is called
+	stopped   chan struct{} // closed when the client stops
+
+	// in-flight window
+	maxreqs  int
+	maxbytes int
+	wreqs    int           // requests admitted to the window
+	wbytes   int           // size of their data
+	wchan    chan struct{} // closed when requests leave the window
+
+	interceptors []Interceptor
+
+	kastop   chan struct{} // closed to stop the keepalive
+	lastrecv time.Time     // time of the last response
 
 	// stats
 	nreqs   int    // number of requests processed
-	tsz     uint64 // total size of the T messages received
-	rsz     uint64 // total size of the R messages sent
+	tsz     uint64 // total size of the T messages sent
+	rsz     uint64 // total size of the R messages received
 	npend   int    // number of currently pending requests
+	pbytes  int    // size of the data in the pending requests
 	maxpend int    // maximum number of pending requests
 	nreads  int    // number of reads from the connection
 	nwrites int    // number of writes to the connection
+	ncalls  [256]int
+	lat     [nlatency]time.Duration // latencies of the last requests
+	nlat    int
 }
 
 type Req struct {
@@ -60,27 +87,107 @@ type Req struct {
 	Err        *vt.Error
 	Done       chan *Req
 	tag        uint8
+	sent       bool            // passed to the sending goroutine
+	scored     bool            // Tc.Score is the expected score of a Twrite
+	write      *Write          // handle of a PutAsync write
+	admitted   bool            // counted in the in-flight window
+	wsize      int             // size of the data counted in the window
+	ctx        context.Context // context the request was issued with
+	retries    int             // times the request was sent again
+	start      time.Time       // time the request was issued
 	next, prev *Req
 }
 
 type pool struct {
 	sync.Mutex
-	need  int
-	nchan chan uint32
-	maxid uint32
-	imap  []byte
+	waiters []chan uint32 // getId calls waiting for a free id
+	maxid   uint32
+	imap    []byte
 }
 
+// Returned by the calls on a client after Hangup.
+var ErrClosed = &vt.Error{"client closed"}
+
+// Returned if the data read from the server doesn't match its score.
+var ErrIntegrity = &vt.Error{"score mismatch"}
+
 var DefaultDebuglevel int
 var DefaultLogger *vt.Logger
 
 func (clnt *Clnt) Rpcnb(r *Req) error {
+	return clnt.rpcnb(context.Background(), r)
+}
+
+// Like Rpcnb, but gives up if the context is done before the request is
+// passed to the sending goroutine. The request is not freed. If the client
+// stops meanwhile, the request fails through its Done channel, and nil is
+// returned.
+func (clnt *Clnt) rpcnb(ctx context.Context, r *Req) error {
+	if r.ctx == nil {
+		r.ctx = ctx
+	}
+
+	err := clnt.intercept(r)
+	if err != nil {
+		return err
+	}
+
+	err = clnt.queue(ctx, r)
+	if err != nil {
+		r.Err = vtError(err)
+		clnt.complete(r)
+	}
+
+	return err
+}
+
+// Links the request and passes it to the sending goroutine.
+func (clnt *Clnt) queue(ctx context.Context, r *Req) (err error) {
 	clnt.Lock()
-	if clnt.err != nil {
+	if !r.admitted {
+		err = clnt.wait(ctx, len(r.Tc.Data))
+		if err == nil {
+			r.admitted = true
+			r.wsize = len(r.Tc.Data)
+		}
+	} else if clnt.err != nil {
+		err = clnt.err
+	}
+
+	if err != nil {
 		clnt.Unlock()
-		return clnt.err
+		return err
 	}
 
+	clnt.link(r)
+	clnt.Unlock()
+
+	select {
+	case clnt.reqout <- r:
+		return nil
+
+	case <-clnt.stopped:
+		clnt.Lock()
+		defer clnt.Unlock()
+		if clnt.remove(r) {
+			return clnt.err
+		}
+
+	case <-ctx.Done():
+		clnt.Lock()
+		defer clnt.Unlock()
+		if clnt.remove(r) {
+			return ctx.Err()
+		}
+	}
+
+	// closed() took it already
+	return nil
+}
+
+// Appends the request to the list of pending requests. Should be called
+// with clnt locked.
+func (clnt *Clnt) link(r *Req) {
 	if clnt.reqlast != nil {
 		clnt.reqlast.next = r
 	} else {
@@ -89,180 +196,349 @@ func (clnt *Clnt) Rpcnb(r *Req) error {
 
 	r.prev = clnt.reqlast
 	clnt.reqlast = r
-	clnt.Unlock()
+	r.start = time.Now()
+	clnt.ncalls[r.Tc.Id]++
+	clnt.npend++
+	clnt.pbytes += len(r.Tc.Data)
+	if clnt.npend > clnt.maxpend {
+		clnt.maxpend = clnt.npend
+	}
+}
+
+// Sends the request and waits for the response. If the context is done
+// first, the request is abandoned and ctx.Err() is returned. The request
+// is freed unless the returned error is nil.
+func (clnt *Clnt) rpc(ctx context.Context, r *Req) error {
+	done := make(chan *Req, 1)
+	r.Done = done
+	err := clnt.rpcnb(ctx, r)
+	if err != nil {
+		clnt.ReqFree(r)
+		return err
+	}
+
+	select {
+	case <-done:
+		if r.Err != nil {
+			err = r.Err
+			clnt.ReqFree(r)
+		}
+
+		return err
+
+	case <-ctx.Done():
+		if !clnt.cancel(r) {
+			// the response arrived meanwhile
+			<-done
+			clnt.ReqFree(r)
+		}
+
+		return ctx.Err()
+	}
+}
+
+// Removes a request that was already sent from the list of pending
+// requests. Its tag stays reserved until the server responds, so the
+// late response can't be matched to a new request. Returns false if
+// the response was already received.
+func (clnt *Clnt) cancel(r *Req) bool {
+	clnt.Lock()
+	defer clnt.Unlock()
+	if !clnt.remove(r) {
+		return false
+	}
+
+	if clnt.stale == nil {
+		clnt.stale = make(map[uint8]*Req)
+	}
+
+	clnt.stale[r.tag] = r
+	return true
+}
+
+// Removes the request from the list of pending requests. Returns false
+// if the request is not in the list. Should be called with clnt locked.
+func (clnt *Clnt) remove(r *Req) bool {
+	for req := clnt.reqfirst; req != r; req = req.next {
+		if req == nil {
+			return false
+		}
+	}
+
+	if r.prev != nil {
+		r.prev.next = r.next
+	} else {
+		clnt.reqfirst = r.next
+	}
+
+	if r.next != nil {
+		r.next.prev = r.prev
+	} else {
+		clnt.reqlast = r.prev
+	}
+
+	r.next = nil
+	r.prev = nil
+	clnt.npend--
+	clnt.pbytes -= len(r.Tc.Data)
+	clnt.leave(r)
+	return true
+}
+
+// Removes the request with the specified tag from the list of pending
+// requests. Returns nil if there is no such request.
+func (clnt *Clnt) unlink(tag uint8) *Req {
+	clnt.Lock()
+	defer clnt.Unlock()
+
+	return clnt.unlinkLocked(tag)
+}
+
+func (clnt *Clnt) unlinkLocked(tag uint8) *Req {
+	for req := clnt.reqfirst; req != nil; req = req.next {
+		if req.tag == tag {
+			clnt.remove(req)
+			return req
+		}
+	}
 
-	clnt.reqout <- r
 	return nil
 }
 
 func (clnt *Clnt) recv() {
 	var err *vt.Error
-	var req *Req
-	var csz int
 
-	err = nil
-	buf := make([]byte, vt.Maxblock*8)
-	pos := 0
-	for {
-		if len(buf) < int(vt.Maxblock) {
-			b := make([]byte, vt.Maxblock*8)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
+	dec := vt.NewDecoder(clnt.conn, clnt.version)
+	for dec != nil {
+		err = clnt.recvConn(dec)
+		clnt.done <- true
+		dec = nil
+		if clnt.reconnect != nil {
+			dec = clnt.redial(err)
 		}
+	}
 
-		n, oserr := clnt.conn.Read(buf[pos:len(buf)])
-		if oserr != nil || n == 0 {
-			err = &vt.Error{oserr.Error()}
-			goto closed
-		}
+	clnt.closed(err)
+}
 
-		pos += n
-		for pos >= 4 {
-			sz, _ := vt.Gint16(buf)
-			sz += 2
-			if sz > vt.Maxblock {
-				err = &vt.Error{fmt.Sprintf("bad client connection: %s", clnt.Id)}
-				clnt.conn.Close()
-				goto closed
-			}
+// Reads the responses from the connection until it fails.
+func (clnt *Clnt) recvConn(dec *vt.Decoder) *vt.Error {
+	var err *vt.Error
 
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, vt.Maxblock*8)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
-				}
+	for {
+		var rc vt.Call
 
-				break
+		e := dec.Decode(&rc)
+		if e != nil {
+			if verr, ok := e.(*vt.Error); ok {
+				err = verr
+			} else {
+				err = &vt.Error{e.Error()}
 			}
 
-			tag, _ := vt.Gint8(buf[3:])
-			clnt.Lock()
-			for req = clnt.reqfirst; req != nil; req = req.next {
-				if req.tag == tag {
-					if req.prev != nil {
-						req.prev.next = req.next
-					} else {
-						clnt.reqfirst = req.next
-					}
+			clnt.conn.Close()
+			return err
+		}
 
-					if req.next != nil {
-						req.next.prev = req.prev
-					} else {
-						clnt.reqlast = req.prev
-					}
+		clnt.Lock()
+		stale := false
+		req := clnt.unlinkLocked(rc.Tag)
+		if req == nil && clnt.stale[rc.Tag] != nil {
+			// response to a cancelled request, the tag can be reused now
+			req = clnt.stale[rc.Tag]
+			delete(clnt.stale, rc.Tag)
+			req.Done = nil
+			stale = true
+		}
 
-					break
-				}
-			}
-			clnt.Unlock()
+		var done chan *Req
+		if req != nil {
+			done = req.Done
+		}
+		clnt.Unlock()
 
-			if req == nil {
-				err = &vt.Error{"unexpected response"}
-				clnt.conn.Close()
-				goto closed
+		if req == nil {
+			err = &vt.Error{"unexpected response"}
+			clnt.conn.Close()
+			return err
+		}
+
+		req.Rc = rc
+		if clnt.Debuglevel > 0 {
+			clnt.logFcall(&req.Rc)
+			if clnt.Debuglevel&DbgPrintPackets != 0 {
+				log.Println("}-}", clnt.Id, fmt.Sprint(req.Rc.Pkt))
 			}
 
-			csz, err = vt.Unpack(buf, &req.Rc)
-			if err != nil {
-				clnt.conn.Close()
-				goto closed
+			if clnt.Debuglevel&DbgPrintCalls != 0 {
+				log.Println("}}}", clnt.Id, req.Rc.String())
 			}
+		}
 
-			if clnt.Debuglevel > 0 {
-				clnt.logFcall(&req.Rc)
-				if clnt.Debuglevel&DbgPrintPackets != 0 {
-					log.Println("}-}", clnt.Id, fmt.Sprint(req.Rc.Pkt))
-				}
+		clnt.Lock()
+		clnt.rsz += uint64(len(rc.Pkt))
+		clnt.lastrecv = time.Now()
+		clnt.latency(time.Since(req.start))
+		clnt.nreads = dec.Nreads()
+		clnt.Unlock()
 
-				if clnt.Debuglevel&DbgPrintCalls != 0 {
-					log.Println("}}}", clnt.Id, req.Rc.String())
+		if req.Tc.Id != req.Rc.Id-1 {
+			if req.Rc.Id != vt.Rerror {
+				req.Err = &vt.Error{"invalid response"}
+			} else {
+				if req.Err == nil {
+					req.Err = vt.ParseError(req.Rc.Ename)
 				}
 			}
+		} else if req.scored && req.Rc.Score != req.Tc.Score {
+			// the server stored something else
+			req.Err = ErrIntegrity
+		} else if cache := clnt.getCache(); req.scored && cache != nil {
+			cache.Put(req.Tc.Score, req.Tc.Btype, req.Tc.Data)
+		}
 
-			if req.Tc.Id != req.Rc.Id-1 {
-				if req.Rc.Id != vt.Rerror {
-					req.Err = &vt.Error{"invalid response"}
-				} else {
-					if req.Err == nil {
-						req.Err = &vt.Error{req.Rc.Ename}
-					}
-				}
-			}
+		retry := clnt.complete(req)
+		retry = retry && !stale && req.retries < MaxRetries
+		if retry && (req.ctx == nil || req.ctx.Err() == nil) {
+			go clnt.retry(req)
+			continue
+		}
 
-			if req.Done != nil {
-				req.Done <- req
-			} else {
-				clnt.ReqFree(req)
-			}
+		clnt.deliver(req, done)
+	}
+}
+
+// Passes the finished request to its Done channel, or frees it if
+// there is none. PutAsync writes are passed to their Write handles.
+func (clnt *Clnt) deliver(req *Req, done chan *Req) {
+	if w := req.write; w != nil {
+		w.req = req
+		close(w.fin)
+		return
+	}
+
+	if done != nil {
+		done <- req
+		return
+	}
 
-			pos -= csz
-			buf = buf[csz:]
+	if req.Err != nil && req.Tc.Id == vt.Twrite {
+		// keep it for Sync
+		clnt.Lock()
+		if clnt.werr == nil {
+			clnt.werr = req.Err
 		}
+		clnt.Unlock()
 	}
 
-closed:
-	clnt.done <- true
+	clnt.ReqFree(req)
+}
 
+// Fails all pending requests after the connection is lost for good.
+func (clnt *Clnt) closed(err *vt.Error) {
 	/* send error to all pending requests */
 	clnt.Lock()
-	if clnt.err != nil {
+	if clnt.err == nil {
 		clnt.err = err
 	}
 
+	err = clnt.err
 	r := clnt.reqfirst
+	for req := r; req != nil; req = req.next {
+		clnt.leave(req)
+	}
+
+	stale := clnt.stale
 	clnt.reqfirst = nil
 	clnt.reqlast = nil
+	clnt.stale = nil
+	clnt.npend = 0
+	clnt.pbytes = 0
+	clnt.wake()
 	clnt.Unlock()
 
-	for ; r != nil; r = r.next {
+	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
+		sop.statsUnregister()
+	}
+
+	// before the requests are failed, the callers may be waiting for it
+	close(clnt.stopped)
+
+	for r != nil {
+		next := r.next
 		r.Err = err
-		if r.Done != nil {
-			r.Done <- r
-		}
+		clnt.complete(r)
+		clnt.deliver(r, r.Done)
+		r = next
 	}
 
-	if sop, ok := (interface{}(clnt)).(StatsOps); ok {
-		sop.statsUnregister()
+	for _, r := range stale {
+		// cancelled, nobody waits for them
+		r.Err = err
+		clnt.complete(r)
+		clnt.ReqFree(r)
 	}
 }
 
 func (clnt *Clnt) send() {
-	buf := make([]byte, 8*vt.Maxblock)
-	pos := 0
-
+	enc := vt.NewEncoder(clnt.conn, clnt.version)
 	for {
 		select {
 		case <-clnt.done:
 			return
 
 		case req := <-clnt.reqout:
-		again:
+			var err error
+
+			var bye *Req
+
 			nreqs := 0
+			size := 0
 			for req != nil {
+				clnt.Lock()
+				req.sent = true
+				clnt.Unlock()
+
 				req.Tc.Tag = req.tag
-				n := vt.Pack(buf[pos:], &req.Tc)
-				if n < 0 {
-					break
-				}
+				err = enc.Encode(&req.Tc)
+				if err == vt.Epacket {
+					// can't be sent, fail only that request
+					clnt.Lock()
+					r := clnt.unlinkLocked(req.tag)
+					if r == nil && clnt.stale[req.tag] == req {
+						delete(clnt.stale, req.tag)
+						req.Done = nil
+						r = req
+					}
+					clnt.Unlock()
 
-				if clnt.Debuglevel > 0 {
-					clnt.logFcall(&req.Rc)
-					if clnt.Debuglevel&DbgPrintPackets != 0 {
-						log.Println("{-{", clnt.Id, fmt.Sprintf("%x", req.Tc.Pkt))
+					if r != nil {
+						req.Err = vt.Epacket
+						clnt.complete(req)
+						clnt.deliver(req, req.Done)
+					}
+				} else if err != nil {
+					break
+				} else {
+					if clnt.Debuglevel > 0 {
+						clnt.logFcall(&req.Tc)
+						if clnt.Debuglevel&DbgPrintPackets != 0 {
+							log.Println("{-{", clnt.Id, fmt.Sprintf("%x", req.Tc.Pkt))
+						}
+
+						if clnt.Debuglevel&DbgPrintCalls != 0 {
+							log.Println("{{{", clnt.Id, req.Tc.String())
+						}
 					}
 
-					if clnt.Debuglevel&DbgPrintCalls != 0 {
-						log.Println("{{{", clnt.Id, req.Tc.String())
+					size += len(req.Tc.Pkt)
+					nreqs++
+					if req.Tc.Id == vt.Tgoodbye {
+						bye = req
 					}
 				}
 
-				pos += n
-				nreqs++
 				// req is freed in recv() if no Done channel was registered, or by the code calling <-Done.
-				//clnt.ReqFree(req)
 				select {
 				default:
 					req = nil
@@ -271,32 +547,37 @@ func (clnt *Clnt) send() {
 				}
 			}
 
-			nwrites := 0
-			for b := buf[0:pos]; len(b) > 0; {
-				n, err := clnt.conn.Write(b)
-				if err != nil {
+			if err == nil || err == vt.Epacket {
+				err = enc.Flush()
+			}
+
+			if bye != nil && err == nil {
+				// there is no response to Tgoodbye, done when written
+				if clnt.unlink(bye.tag) != nil {
+					clnt.complete(bye)
+					if bye.Done != nil {
+						bye.Done <- bye
+					}
+				}
+			}
+
+			if err != nil {
+				if clnt.reconnect == nil {
 					clnt.Lock()
 					clnt.err = &vt.Error{err.Error()}
 					clnt.Unlock()
-
-					/* just close the socket, will get signal on conn.done */
-					log.Println("error while writing")
-					clnt.conn.Close()
-					break
 				}
-				nwrites++
-				b = b[n:]
+
+				/* just close the socket, will get signal on conn.done */
+				log.Println("error while writing")
+				clnt.conn.Close()
 			}
 
 			clnt.Lock()
-			clnt.rsz += uint64(pos)
-			clnt.npend -= nreqs
-			clnt.nwrites += nwrites
+			clnt.tsz += uint64(size)
+			clnt.nreqs += nreqs
+			clnt.nwrites = enc.Nwrites()
 			clnt.Unlock()
-			pos = 0
-			if req != nil {
-				goto again
-			}
 		}
 	}
 }
@@ -304,17 +585,31 @@ func (clnt *Clnt) send() {
 // Creates and initializes a new Clnt object. Doesn't send any data
 // on the wire.
 func NewClnt(c net.Conn) *Clnt {
+	return newClnt(c, nil, nil)
+}
+
+// Creates a Clnt that reconnects as specified by r, using dial to
+// establish the new connections.
+func newClnt(c net.Conn, r *Reconnect, dial dialFunc) *Clnt {
 	clnt := new(Clnt)
 	clnt.conn = c
+	clnt.reconnect = r
+	clnt.dial = dial
 	clnt.Debuglevel = DefaultDebuglevel
 	clnt.Log = DefaultLogger
 	clnt.tagpool = newPool(uint32(255))
 	clnt.reqout = make(chan *Req)
 	clnt.done = make(chan bool)
 	clnt.reqchan = make(chan *Req, 16)
-	clnt.schan = make(chan hash.Hash, 32)
+	clnt.hangup = make(chan struct{})
+	clnt.stopped = make(chan struct{})
+	clnt.lastrecv = time.Now()
 
-	processBanner(c)
+	clnt.Id = c.LocalAddr().String()
+	if clnt.Id == "" || clnt.Id == "@" {
+		clnt.Id = c.RemoteAddr().String()
+	}
+	clnt.version = processBanner(c)
 	go clnt.recv()
 	go clnt.send()
 
@@ -325,56 +620,115 @@ func NewClnt(c net.Conn) *Clnt {
 }
 
 func Connect(ntype, addr string) (clnt *Clnt, err error) {
-	c, e := net.Dial(ntype, addr)
+	return ConnectContext(context.Background(), ntype, addr)
+}
+
+// Like Connect, but gives up when the context is done. The context is
+// used only while the connection is established.
+func ConnectContext(ctx context.Context, ntype, addr string) (clnt *Clnt, err error) {
+	return connect(ctx, netDial(ntype, addr), nil)
+}
+
+// Establishes connections to the server.
+type dialFunc func(ctx context.Context) (net.Conn, error)
+
+func netDial(ntype, addr string) dialFunc {
+	return func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+
+		return d.DialContext(ctx, ntype, addr)
+	}
+}
+
+// Connects to the server using dial. If r is not nil, the client
+// reconnects with dial when the connection is lost.
+func connect(ctx context.Context, dial dialFunc, r *Reconnect) (clnt *Clnt, err error) {
+	c, e := dial(ctx)
 	if e != nil {
 		return nil, &vt.Error{e.Error()}
 	}
 
-	clnt = NewClnt(c)
-	req := clnt.ReqAlloc()
-	req.Done = make(chan *Req)
-	tc := &req.Tc
-	tc.Id = vt.Thello
-	tc.Version = "02"
-	tc.Uid = "anonymous"
-	tc.Strength = 0
-	tc.Crypto = make([]byte, 0)
-	tc.Codec = tc.Crypto
+	// interrupt the banner exchange if the context is done
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Unix(1, 0)) })
+	clnt = newClnt(c, r, dial)
+	if !stop() {
+		c.Close()
+		return nil, ctx.Err()
+	}
 
-	err = clnt.Rpcnb(req)
+	if clnt.version == 0 {
+		c.Close()
+		return nil, vt.Eversion
+	}
+
+	req, err := clnt.reqAlloc(ctx)
 	if err != nil {
-		return
+		c.Close()
+		return nil, err
 	}
 
-	<-req.Done
-	if req.Err != nil {
-		err = req.Err
+	clnt.hello(&req.Tc)
+	err = clnt.rpc(ctx, req)
+	if err != nil {
+		c.Close()
+		return nil, err
 	}
-	clnt.ReqFree(req)
 
+	clnt.ReqFree(req)
 	return
 }
 
+// Prepares the Thello message sent when connecting.
+func (clnt *Clnt) hello(tc *vt.Call) {
+	tc.Id = vt.Thello
+	tc.Version = vt.VersionString(clnt.version)
+	tc.Uid = "anonymous"
+	tc.Strength = 0
+	tc.Crypto = make([]byte, 0)
+	tc.Codec = tc.Crypto
+}
+
 func (clnt *Clnt) ReqAlloc() *Req {
+	req, _ := clnt.reqAlloc(context.Background())
+	return req
+}
+
+// Like ReqAlloc, but gives up if the context is done while waiting
+// for a free tag.
+func (clnt *Clnt) reqAlloc(ctx context.Context) (*Req, error) {
 	var req *Req
 
 	select {
 	default:
+		tag, err := clnt.tagpool.getIdContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
 		req = new(Req)
 		req.Clnt = clnt
-		req.tag = uint8(clnt.tagpool.getId())
+		req.tag = uint8(tag)
 
 	case req = <-clnt.reqchan:
 	}
 
-	return req
+	return req, nil
 }
 
 func (clnt *Clnt) ReqFree(req *Req) {
+	clnt.Lock()
+	clnt.leave(req)
+	clnt.Unlock()
+
 	req.Tc.Clear()
 	req.Rc.Clear()
 	req.Err = nil
 	req.Done = nil
+	req.sent = false
+	req.scored = false
+	req.write = nil
+	req.ctx = nil
+	req.retries = 0
 	req.next = nil
 	req.prev = nil
 
@@ -386,95 +740,445 @@ func (clnt *Clnt) ReqFree(req *Req) {
 	}
 }
 
-func (clnt *Clnt) Getnb(score vt.Score, btype uint8, count uint16, done chan *Req) (err error) {
-	req := clnt.ReqAlloc()
+func (clnt *Clnt) Getnb(score vt.Score, btype uint8, count uint32, done chan *Req) (err error) {
+	return clnt.GetnbContext(context.Background(), score, btype, count, done)
+}
+
+// Like Getnb, but gives up if the context is done before the request
+// is sent. The context doesn't affect the request once it's sent.
+func (clnt *Clnt) GetnbContext(ctx context.Context, score vt.Score, btype uint8, count uint32, done chan *Req) (err error) {
+	req, err := clnt.readReq(ctx, score, btype, count)
+	if err != nil {
+		return
+	}
+
 	req.Done = done
+	err = clnt.rpcnb(ctx, req)
+	if err != nil {
+		clnt.ReqFree(req)
+	}
+
+	return
+}
+
+// Allocates a request and prepares a Tread for the block.
+func (clnt *Clnt) readReq(ctx context.Context, score vt.Score, btype uint8, count uint32) (*Req, error) {
+	if !vt.CheckType(btype) {
+		return nil, vt.ErrBadType
+	}
+
+	if max := uint32(vt.MaxblockVersion(clnt.version)); count > max {
+		count = max
+	}
+
+	req, err := clnt.windowReq(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+
 	tc := &req.Tc
 	tc.Id = vt.Tread
 	tc.Score = score
 	tc.Btype = btype
 	tc.Count = count
 
-	err = clnt.Rpcnb(req)
-	if err != nil {
-		clnt.ReqFree(req)
-	}
+	return req, nil
+}
 
-	return
+// Reads a block from the server. Pointer blocks are zero-extended to count
+// bytes, directory blocks to a whole number of entries (see vt.ExtendSize).
+// The Zeroscore block is returned without contacting the server.
+func (clnt *Clnt) Get(score vt.Score, btype uint8, count uint32) (data []byte, err error) {
+	return clnt.GetContext(context.Background(), score, btype, count)
 }
 
-func (clnt *Clnt) Get(score vt.Score, btype uint8, count uint16) (data []byte, err error) {
-	done := make(chan *Req)
-	err = clnt.Getnb(score, btype, count, done)
+// Like Get, but returns ctx.Err() if the context is done before the
+// response arrives.
+func (clnt *Clnt) GetContext(ctx context.Context, score vt.Score, btype uint8, count uint32) (data []byte, err error) {
+	data, ok := clnt.local(score, btype, count)
+	if ok {
+		return
+	}
+
+	req, err := clnt.readReq(ctx, score, btype, count)
 	if err != nil {
 		return
 	}
 
-	req := <-done
-	if req.Err != nil {
-		err = req.Err
-		clnt.ReqFree(req)
+	err = clnt.rpc(ctx, req)
+	if err != nil {
 		return
 	}
 
-	data = req.Rc.Data
+	return clnt.readDone(req, count)
+}
+
+// Returns the block if it can be read without contacting the server,
+// i.e. it's the Zeroscore block, or it's in the cache. The scores of the
+// cached blocks were checked when they were added.
+func (clnt *Clnt) local(score vt.Score, btype uint8, count uint32) ([]byte, bool) {
+	if score == vt.Zeroscore {
+		return clnt.extend(btype, nil, count), true
+	}
+
+	if cache := clnt.getCache(); cache != nil {
+		data, ok := cache.Get(score, btype)
+		if ok {
+			return clnt.extend(btype, data, count), true
+		}
+	}
+
+	return nil, false
+}
+
+// Returns the data read by a successful Tread request and frees the
+// request. The data is verified, cached, and extended to count bytes.
+func (clnt *Clnt) readDone(req *Req, count uint32) ([]byte, error) {
+	score, btype := req.Tc.Score, req.Tc.Btype
+	data := req.Rc.Data
 	clnt.ReqFree(req)
-	return
+	err := clnt.Verify(score, btype, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache := clnt.getCache(); cache != nil {
+		cache.Put(score, btype, data)
+	}
+
+	return clnt.extend(btype, data, count), nil
+}
+
+// Zero-extends the block to the size returned by vt.ExtendSize. The
+// data is copied if it's extended, it may be shared with the cache.
+func (clnt *Clnt) extend(btype uint8, data []byte, count uint32) []byte {
+	size := vt.ExtendSize(btype, len(data), int(count))
+	return vt.ZeroExtend(btype, data[0:len(data):len(data)], size)
+}
+
+// Returns the number of requests waiting for a response.
+func (clnt *Clnt) Pending() int {
+	clnt.Lock()
+	defer clnt.Unlock()
+
+	return clnt.npend
 }
 
-// Put is always async, Sync will make sure all Puts finished before returning
+// Checks that the block read from the server matches its score. Servers
+// may return the block with its trailing zeros, so the data is also
+// checked after zero truncation. Always succeeds if NoVerify is set.
+func (clnt *Clnt) Verify(score vt.Score, btype uint8, data []byte) error {
+	if clnt.NoVerify || checkScore(score, btype, data) {
+		return nil
+	}
+
+	return ErrIntegrity
+}
+
+// Returns true if the data, or the data without its trailing zeros,
+// matches the score.
+func checkScore(score vt.Score, btype uint8, data []byte) bool {
+	if vt.Score(sha1.Sum(data)) == score {
+		return true
+	}
+
+	t := vt.ZeroTruncate(btype, data)
+	return len(t) < len(data) && vt.Score(sha1.Sum(t)) == score
+}
+
+// Put is always async, Sync will make sure all Puts finished before returning.
+// The trailing zeros are removed from the data before it is sent. Empty blocks
+// are not sent to the server.
 func (clnt *Clnt) Put(btype uint8, data []byte) (score vt.Score, err error) {
-	req := clnt.ReqAlloc()
-	tc := &req.Tc
-	tc.Id = vt.Twrite
-	tc.Btype = btype
-	tc.Data = data
+	return clnt.PutContext(context.Background(), btype, data)
+}
 
-	err = clnt.Rpcnb(req)
+// Like Put, but returns ctx.Err() if the context is done before the
+// write is queued. The context doesn't affect queued writes.
+func (clnt *Clnt) PutContext(ctx context.Context, btype uint8, data []byte) (score vt.Score, err error) {
+	req, err := clnt.writeReq(ctx, btype, data)
+	if err != nil || req == nil {
+		return vt.Zeroscore, err
+	}
+
+	score = req.Tc.Score
+	err = clnt.rpcnb(ctx, req)
 	if err != nil {
 		clnt.ReqFree(req)
-	} else {
-		score = clnt.calcScore(data)
+		return vt.Score{}, err
 	}
 
 	return
 }
 
-func (clnt *Clnt) Sync() (err error) {
-	done := make(chan *Req)
-	req := clnt.ReqAlloc()
-	req.Done = done
-	tc := &req.Tc
-	tc.Id = vt.Tsync
+// Write is a handle for a block written by PutAsync.
+type Write struct {
+	Score vt.Score // score of the block
+	once  sync.Once
+	fin   chan struct{} // closed when the write finishes
+	req   *Req
+	err   error
+}
+
+// Starts writing a block like Put, and returns a handle that can be
+// used to wait for the server's response. Sync waits for the write to
+// finish, but its errors are returned by Wait, not Sync.
+func (clnt *Clnt) PutAsync(btype uint8, data []byte) *Write {
+	w := new(Write)
+	req, err := clnt.writeReq(context.Background(), btype, data)
+	if err != nil || req == nil {
+		w.err = err
+		if err == nil {
+			w.Score = vt.Zeroscore
+		}
+
+		return w
+	}
+
+	w.Score = req.Tc.Score
+	w.fin = make(chan struct{})
+	req.write = w
 	err = clnt.Rpcnb(req)
 	if err != nil {
 		clnt.ReqFree(req)
+		w.err = err
+		w.fin = nil
+	}
+
+	return w
+}
+
+// Waits for the server's response to the write. Returns the error from
+// the server, or ErrIntegrity if the server returned a different score.
+func (w *Write) Wait() error {
+	w.once.Do(func() {
+		if w.fin == nil {
+			return
+		}
+
+		<-w.fin
+		req := w.req
+		if req.Err != nil {
+			w.err = req.Err
+		}
+
+		req.Clnt.ReqFree(req)
+	})
+
+	return w.err
+}
+
+// Allocates a request and prepares a Twrite for the block. Tc.Score is set
+// to the expected score. Returns nil if the block is empty and doesn't
+// need to be sent.
+func (clnt *Clnt) writeReq(ctx context.Context, btype uint8, data []byte) (*Req, error) {
+	if !vt.CheckType(btype) {
+		return nil, vt.ErrBadType
+	}
+
+	data = vt.ZeroTruncate(btype, data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if len(data) > vt.MaxblockVersion(clnt.version) {
+		return nil, vt.ErrTooBig
+	}
+
+	req, err := clnt.windowReq(ctx, len(data))
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &req.Tc
+	tc.Id = vt.Twrite
+	tc.Btype = btype
+	tc.Data = data
+	tc.Score = vt.Score(sha1.Sum(data))
+	req.scored = true
+
+	return req, nil
+}
+
+// Waits for the outstanding Puts and PutAsyncs to finish and asks the
+// server to store the written blocks. Returns the first error from the
+// Puts since the previous Sync, including the ones that finished already.
+func (clnt *Clnt) Sync() (err error) {
+	return clnt.SyncContext(context.Background())
+}
+
+// Like Sync, but returns ctx.Err() if the context is done before all
+// outstanding writes finish. The writes are not cancelled, and their
+// errors are reported by the next Sync.
+func (clnt *Clnt) SyncContext(ctx context.Context) (err error) {
+	req, err := clnt.windowReq(ctx, 0)
+	if err != nil {
 		return
 	}
 
+	tc := &req.Tc
+	tc.Id = vt.Tsync
+
 	// set all outstanding Twrites to report when they are done
+	var async []*Write
 	clnt.Lock()
 	n := 1
 	for r := clnt.reqfirst; r != nil; r = r.next {
-		if r.Tc.Id == vt.Twrite {
-			r.Done = done
+		switch {
+		case r.Tc.Id != vt.Twrite:
+		case r.write != nil:
+			async = append(async, r.write)
+		case r.Done == nil:
 			n++
 		}
 	}
+
+	done := make(chan *Req, n)
+	for r := clnt.reqfirst; r != nil; r = r.next {
+		if r.Tc.Id == vt.Twrite && r.write == nil && r.Done == nil {
+			r.Done = done
+		}
+	}
 	clnt.Unlock()
 
+	req.Done = done
+	err = clnt.rpcnb(ctx, req)
+	if err != nil {
+		clnt.ReqFree(req)
+		n--
+	}
+
 	for n > 0 {
-		req := <-done
-		if req.Err != nil && err != nil {
-			err = req.Err
+		select {
+		case r := <-done:
+			if r.Err != nil && err == nil {
+				err = r.Err
+			}
+
+			clnt.ReqFree(r)
+			n--
+
+		case <-ctx.Done():
+			// let recv free the requests that didn't finish yet
+			clnt.Lock()
+			for r := clnt.reqfirst; r != nil; r = r.next {
+				if r.Done == done {
+					r.Done = nil
+					n--
+				}
+			}
+			clnt.Unlock()
+
+			// the rest are already on their way
+			for ; n > 0; n-- {
+				r := <-done
+				if r.Err != nil && r.Tc.Id == vt.Twrite {
+					clnt.Lock()
+					if clnt.werr == nil {
+						clnt.werr = r.Err
+					}
+					clnt.Unlock()
+				}
+
+				clnt.ReqFree(r)
+			}
+
+			return ctx.Err()
 		}
+	}
 
-		n--
+	// the PutAsync errors are left for Wait
+	for _, w := range async {
+		select {
+		case <-w.fin:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// errors from the writes that finished before
+	clnt.Lock()
+	if clnt.werr != nil {
+		err = clnt.werr
+		clnt.werr = nil
 	}
+	clnt.Unlock()
 
 	return
 }
 
+// Waits for the outstanding writes to finish, says goodbye to the server
+// and closes the connection. The pending requests and all calls made
+// after Hangup fail with ErrClosed. Returns the error from the writes.
+func (clnt *Clnt) Hangup() (err error) {
+	clnt.Lock()
+	if clnt.closing {
+		clnt.Unlock()
+		return ErrClosed
+	}
+
+	clnt.closing = true
+	close(clnt.hangup)
+	clnt.Unlock()
+
+	err = clnt.Sync()
+
+	req := clnt.ReqAlloc()
+	req.Done = make(chan *Req, 1)
+	req.Tc.Id = vt.Tgoodbye
+	refused := clnt.intercept(req) != nil
+
+	clnt.Lock()
+	cerr := clnt.err
+	if cerr == nil {
+		clnt.err = ErrClosed
+		if !refused {
+			clnt.link(req)
+		}
+	}
+	clnt.Unlock()
+
+	switch {
+	case refused:
+		// an interceptor doesn't want a goodbye, just hang up
+
+	case cerr != nil:
+		req.Err = cerr
+		clnt.complete(req)
+
+	default:
+		select {
+		case clnt.reqout <- req:
+			<-req.Done
+
+		case <-clnt.stopped:
+			clnt.Lock()
+			ok := clnt.remove(req)
+			clnt.Unlock()
+			if ok {
+				req.Err = ErrClosed
+				clnt.complete(req)
+			} else {
+				// failed by closed()
+				<-req.Done
+			}
+		}
+	}
+
+	clnt.ReqFree(req)
+	clnt.Lock()
+	clnt.conn.Close()
+	clnt.Unlock()
+
+	<-clnt.stopped
+	return
+}
+
+// Same as Hangup.
+func (clnt *Clnt) Close() error {
+	return clnt.Hangup()
+}
+
 func (clnt *Clnt) logFcall(c *vt.Call) {
 	if clnt.Debuglevel&DbgLogPackets != 0 {
 		pkt := make([]byte, len(c.Pkt))
@@ -490,41 +1194,21 @@ func (clnt *Clnt) logFcall(c *vt.Call) {
 	}
 }
 
-func (clnt *Clnt) calcScore(data []byte) (ret vt.Score) {
-	var s1 hash.Hash
-
-	select {
-	default:
-		s1 = sha1.New()
-	case s1 = <-clnt.schan:
-		s1.Reset()
-	}
-
-	s1.Write(data)
-	ret = s1.Sum(nil)
-
-	select {
-	case clnt.schan <- s1:
-		break
-	default:
-	}
-
-	return
-}
-
-func processBanner(c net.Conn) bool {
+// Exchanges banners with the server. Returns the highest protocol
+// version supported by both sides, or 0 if there is none.
+func processBanner(c net.Conn) int {
 	var i int
 
 	n, err := c.Write([]byte(vt.Banner))
 	if err != nil || n != len(vt.Banner) {
-		return false
+		return 0
 	}
 
 	buf := make([]byte, 1024)
 	for i = 0; i < len(buf); i++ {
 		n, err := c.Read(buf[i : i+1])
 		if err != nil || n != 1 {
-			return false
+			return 0
 		}
 
 		if buf[i] == '\n' {
@@ -532,5 +1216,5 @@ func processBanner(c net.Conn) bool {
 		}
 	}
 
-	return vt.CheckBanner(string(buf[0:i]))
+	return vt.BannerVersion(string(buf[0:i]))
 }
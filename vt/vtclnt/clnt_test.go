@@ -0,0 +1,73 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+)
+
+// Sync waits for the writes started by PutAsync, but leaves their
+// errors to Wait.
+func TestPutAsyncSync(t *testing.T) {
+	srv, addr := startRam(t)
+	clnt := connect(t, addr)
+
+	srv.Lock()
+	srv.delay = 50 * time.Millisecond
+	srv.Unlock()
+
+	ws := make([]*vtclnt.Write, 10)
+	for i := range ws {
+		ws[i] = clnt.PutAsync(vt.DataBlock, block(i))
+	}
+
+	err := clnt.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	for i, w := range ws {
+		if !srv.stored(w.Score) {
+			t.Errorf("block %d not stored after Sync", i)
+		}
+	}
+
+	for i, w := range ws {
+		if err := w.Wait(); err != nil {
+			t.Errorf("Wait %d: %v", i, err)
+		}
+	}
+
+	srv.Lock()
+	srv.lie = true
+	srv.Unlock()
+
+	w := clnt.PutAsync(vt.DataBlock, block(len(ws)))
+	err = clnt.Sync()
+	if err != nil {
+		t.Errorf("Sync returned the PutAsync error %v", err)
+	}
+
+	if !srv.stored(w.Score) {
+		t.Errorf("block not stored after Sync")
+	}
+
+	if err := w.Wait(); err != vtclnt.ErrIntegrity {
+		t.Errorf("Wait returned %v, expected %v", err, vtclnt.ErrIntegrity)
+	}
+
+	_, err = clnt.Put(vt.DataBlock, block(len(ws)+1))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	if err := clnt.Sync(); err != vtclnt.ErrIntegrity {
+		t.Errorf("Sync returned %v, expected %v", err, vtclnt.ErrIntegrity)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mischief/govt/vt"
+)
+
+// Pool spreads the requests over several connections to the same server.
+// Each request goes to the connection with the least pending requests.
+// Pool has the same methods as Clnt. Blocks written with Put may be read
+// back through a different connection, so they are guaranteed to be
+// readable only after Sync.
+type Pool struct {
+	clnts []*Clnt
+}
+
+// Creates a Pool of n connections to the server.
+func ConnectPool(ntype, addr string, n int) (*Pool, error) {
+	return ConnectPoolContext(context.Background(), ntype, addr, n)
+}
+
+// Like ConnectPool, but gives up when the context is done.
+func ConnectPoolContext(ctx context.Context, ntype, addr string, n int) (*Pool, error) {
+	if n < 1 {
+		n = 1
+	}
+
+	p := new(Pool)
+	for i := 0; i < n; i++ {
+		clnt, err := ConnectContext(ctx, ntype, addr)
+		if err != nil {
+			p.Hangup()
+			return nil, err
+		}
+
+		p.clnts = append(p.clnts, clnt)
+	}
+
+	return p, nil
+}
+
+// Creates a Pool from connected clients.
+func NewPool(clnts ...*Clnt) *Pool {
+	p := new(Pool)
+	p.clnts = append(p.clnts, clnts...)
+
+	return p
+}
+
+// Returns the clients in the pool.
+func (p *Pool) Clnts() []*Clnt {
+	return p.clnts
+}
+
+// Returns the client with the least pending requests. Clients with
+// failed connections are used only if all of them failed.
+func (p *Pool) pick() *Clnt {
+	var best *Clnt
+
+	bestn := -1
+	for _, clnt := range p.clnts {
+		clnt.Lock()
+		n, failed := clnt.npend, clnt.err != nil
+		clnt.Unlock()
+
+		if failed {
+			continue
+		}
+
+		if bestn < 0 || n < bestn {
+			best, bestn = clnt, n
+		}
+	}
+
+	if best == nil {
+		best = p.clnts[0]
+	}
+
+	return best
+}
+
+func (p *Pool) Getnb(score vt.Score, btype uint8, count uint32, done chan *Req) error {
+	return p.pick().Getnb(score, btype, count, done)
+}
+
+func (p *Pool) GetnbContext(ctx context.Context, score vt.Score, btype uint8, count uint32, done chan *Req) error {
+	return p.pick().GetnbContext(ctx, score, btype, count, done)
+}
+
+func (p *Pool) Get(score vt.Score, btype uint8, count uint32) ([]byte, error) {
+	return p.pick().Get(score, btype, count)
+}
+
+func (p *Pool) GetContext(ctx context.Context, score vt.Score, btype uint8, count uint32) ([]byte, error) {
+	return p.pick().GetContext(ctx, score, btype, count)
+}
+
+func (p *Pool) GetMany(ctx context.Context, reqs []Request, unordered bool) <-chan Result {
+	return p.pick().GetMany(ctx, reqs, unordered)
+}
+
+func (p *Pool) Put(btype uint8, data []byte) (vt.Score, error) {
+	return p.pick().Put(btype, data)
+}
+
+func (p *Pool) PutContext(ctx context.Context, btype uint8, data []byte) (vt.Score, error) {
+	return p.pick().PutContext(ctx, btype, data)
+}
+
+func (p *Pool) PutAsync(btype uint8, data []byte) *Write {
+	return p.pick().PutAsync(btype, data)
+}
+
+// Frees a request returned by Getnb.
+func (p *Pool) ReqFree(req *Req) {
+	req.Clnt.ReqFree(req)
+}
+
+// Checks the block like Clnt.Verify. The check is skipped only if
+// NoVerify is set on all clients in the pool.
+func (p *Pool) Verify(score vt.Score, btype uint8, data []byte) error {
+	for _, clnt := range p.clnts {
+		if !clnt.NoVerify {
+			return clnt.Verify(score, btype, data)
+		}
+	}
+
+	return nil
+}
+
+// Enables or disables the checking of the blocks read on each client
+// in the pool.
+func (p *Pool) SetVerify(verify bool) {
+	for _, clnt := range p.clnts {
+		clnt.NoVerify = !verify
+	}
+}
+
+// Returns the number of requests waiting for a response on all
+// connections.
+func (p *Pool) Pending() int {
+	n := 0
+	for _, clnt := range p.clnts {
+		n += clnt.Pending()
+	}
+
+	return n
+}
+
+// Sets the cache of each client in the pool. The clients share it.
+func (p *Pool) SetCache(c *Cache) {
+	for _, clnt := range p.clnts {
+		clnt.SetCache(c)
+	}
+}
+
+// Adds interceptors to each client in the pool.
+func (p *Pool) Use(ic ...Interceptor) {
+	for _, clnt := range p.clnts {
+		clnt.Use(ic...)
+	}
+}
+
+// Sets the window of each client in the pool.
+func (p *Pool) SetWindow(maxreqs, maxbytes int) {
+	for _, clnt := range p.clnts {
+		clnt.SetWindow(maxreqs, maxbytes)
+	}
+}
+
+// Returns the window usage of all clients in the pool.
+func (p *Pool) Window() (reqs, bytes int) {
+	for _, clnt := range p.clnts {
+		r, b := clnt.Window()
+		reqs += r
+		bytes += b
+	}
+
+	return
+}
+
+// Pings the servers of all clients in parallel. Returns the longest
+// round-trip time and the first error.
+func (p *Pool) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	var mu sync.Mutex
+
+	err = p.all(func(clnt *Clnt) error {
+		d, err := clnt.Ping(ctx)
+		mu.Lock()
+		if d > rtt {
+			rtt = d
+		}
+		mu.Unlock()
+
+		return err
+	})
+
+	return
+}
+
+// Sets the keepalive of each client in the pool.
+func (p *Pool) Keepalive(interval, timeout time.Duration) {
+	for _, clnt := range p.clnts {
+		clnt.Keepalive(interval, timeout)
+	}
+}
+
+// Returns the statistics of all clients in the pool. The counters are
+// summed, MaxPending is the sum of the clients' maxima, and the latency
+// percentiles are computed over the last requests of all clients.
+func (p *Pool) Stats() *Stats {
+	var lat []time.Duration
+
+	st := new(Stats)
+	st.Calls = make(map[string]int)
+	for _, clnt := range p.clnts {
+		lat = append(lat, clnt.addStats(st)...)
+	}
+
+	st.percentiles(lat)
+	return st
+}
+
+func (p *Pool) Sync() error {
+	return p.SyncContext(context.Background())
+}
+
+// Syncs all clients in parallel. Returns the first error.
+func (p *Pool) SyncContext(ctx context.Context) error {
+	return p.all(func(clnt *Clnt) error { return clnt.SyncContext(ctx) })
+}
+
+// Hangs up all clients. Returns the first error.
+func (p *Pool) Hangup() error {
+	return p.all((*Clnt).Hangup)
+}
+
+func (p *Pool) Close() error {
+	return p.Hangup()
+}
+
+// Calls f for all clients in parallel and returns the first error.
+func (p *Pool) all(f func(clnt *Clnt) error) (err error) {
+	errc := make(chan error, len(p.clnts))
+	for _, clnt := range p.clnts {
+		go func(clnt *Clnt) { errc <- f(clnt) }(clnt)
+	}
+
+	for range p.clnts {
+		if e := <-errc; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
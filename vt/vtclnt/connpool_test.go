@@ -0,0 +1,69 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+)
+
+func TestPool(t *testing.T) {
+	const n = 3
+
+	_, addr := startRam(t)
+	p, err := vtclnt.ConnectPool("tcp", addr, n)
+	if err != nil {
+		t.Fatalf("ConnectPool: %v", err)
+	}
+
+	defer p.Hangup()
+
+	score, err := p.Put(vt.DataBlock, block(0))
+	if err == nil {
+		err = p.Sync()
+	}
+
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	data, err := p.Get(score, vt.DataBlock, 8192)
+	if err != nil || !bytes.Equal(data, block(0)) {
+		t.Fatalf("Get: %q, %v", data, err)
+	}
+
+	rtt, err := p.Ping(context.Background())
+	if err != nil || rtt <= 0 {
+		t.Fatalf("Ping: %v, %v", rtt, err)
+	}
+
+	st := p.Stats()
+	nreqs := 0
+	for _, clnt := range p.Clnts() {
+		nreqs += clnt.Stats().Nreqs
+	}
+
+	if st.Nreqs != nreqs || st.Calls["Tping"] != n || st.Calls["Tsync"] != n {
+		t.Errorf("pool stats %+v, %d requests on the clients", st, nreqs)
+	}
+
+	if st.LatencyMax <= 0 || st.Latency50 > st.LatencyMax {
+		t.Errorf("pool latencies %v %v", st.Latency50, st.LatencyMax)
+	}
+
+	p.Keepalive(10*time.Millisecond, time.Second)
+	time.Sleep(100 * time.Millisecond)
+	p.Keepalive(0, 0)
+	for i, clnt := range p.Clnts() {
+		if clnt.Stats().Calls["Tping"] < 2 {
+			t.Errorf("client %d wasn't kept alive: %v", i, clnt.Stats().Calls)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+)
+
+// The port venti servers listen on.
+const DefaultPort = "17034"
+
+// Converts a venti address to the network and address used by Connect.
+// The address can be a Plan 9 dial string (tcp!host!venti, tcp!host!17034,
+// unix!/path/sock), a host or a host:port. The port defaults to
+// DefaultPort. An empty address means the value of $venti, or the
+// local host if it is not set.
+func ParseAddr(addr string) (ntype, address string) {
+	if addr == "" {
+		addr = os.Getenv("venti")
+	}
+
+	if addr == "" {
+		addr = "localhost"
+	}
+
+	if strings.Contains(addr, "!") {
+		f := strings.SplitN(addr, "!", 3)
+		ntype, host := f[0], f[1]
+		switch ntype {
+		case "unix":
+			return ntype, strings.Join(f[1:], "!")
+
+		case "net", "":
+			ntype = "tcp"
+		}
+
+		port := DefaultPort
+		if len(f) > 2 && f[2] != "venti" {
+			port = f[2]
+		}
+
+		if host == "*" {
+			host = ""
+		}
+
+		return ntype, net.JoinHostPort(host, port)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, DefaultPort)
+	}
+
+	return "tcp", addr
+}
+
+// Connects to the venti server at addr, see ParseAddr.
+func Dial(addr string) (*Clnt, error) {
+	return DialContext(context.Background(), addr)
+}
+
+// Like Dial, but gives up when the context is done.
+func DialContext(ctx context.Context, addr string) (*Clnt, error) {
+	ntype, address := ParseAddr(addr)
+	return ConnectContext(ctx, ntype, address)
+}
+
+// Connects to the venti server at addr (see ParseAddr) over TLS. To
+// authenticate the client, add its certificate to the config. The client
+// doesn't reconnect, use ConnectTLSRetry for that.
+func ConnectTLS(addr string, config *tls.Config) (*Clnt, error) {
+	return ConnectTLSContext(context.Background(), addr, config)
+}
+
+// Like ConnectTLS, but gives up when the context is done.
+func ConnectTLSContext(ctx context.Context, addr string, config *tls.Config) (*Clnt, error) {
+	return connect(ctx, tlsDial(addr, config), nil)
+}
+
+func tlsDial(addr string, config *tls.Config) dialFunc {
+	ntype, address := ParseAddr(addr)
+	d := &tls.Dialer{Config: config}
+
+	return func(ctx context.Context) (net.Conn, error) {
+		return d.DialContext(ctx, ntype, address)
+	}
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/mischief/govt/vt/vtclnt"
 )
 
-var host = flag.String("host", os.Getenv("venti"), "server address")
+var host = flag.String("host", "", "server address (default $venti)")
 var debug = flag.Int("debug", 0, "print debug messages")
 var vtype = flag.Int("type", vt.DataBlock, "block type")
 
@@ -33,10 +33,7 @@ func main() {
 		fmt.Fprintf(os.Stderr, "error reading input: %s\n", err)
 		return
 	}
-	if *host == "" {
-		*host = ":17034"
-	}
-	clnt, e := vtclnt.Connect("tcp", *host)
+	clnt, e := vtclnt.Dial(*host)
 	if e != nil {
 		fmt.Fprintf(os.Stderr, "vtconnect: %s\n", e)
 		return
@@ -47,7 +44,10 @@ func main() {
 		fmt.Fprintf(os.Stderr, "vtwrite: %s\n", e)
 		return
 	}
-	clnt.Sync()
-	//TODO: clnt.Hangup()
+	e = clnt.Hangup()
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "vtsync: %s\n", e)
+		return
+	}
 	fmt.Printf("%v\n", score)
 }
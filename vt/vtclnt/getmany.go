@@ -0,0 +1,164 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mischief/govt/vt"
+)
+
+// Request describes a block read by GetMany.
+type Request struct {
+	Score vt.Score
+	Btype uint8
+	Count uint32
+}
+
+// Result is the outcome of a GetMany request.
+type Result struct {
+	Index int // index of the request in the slice passed to GetMany
+	Data  []byte
+	Err   error
+}
+
+// Reads the blocks described by reqs like Get, keeping as many requests
+// on the wire as the in-flight window allows. Returns a channel that
+// receives one Result for each request, and is closed after the last
+// one. The results are sent in the order of the requests, or in the
+// order they complete if unordered is set. If the context is done, the
+// requests that didn't complete fail with ctx.Err().
+func (clnt *Clnt) GetMany(ctx context.Context, reqs []Request, unordered bool) <-chan Result {
+	var mu sync.Mutex
+
+	out := make(chan Result, len(reqs))
+	done := make(chan *Req, len(reqs))
+	local := make(chan Result, len(reqs)) // results not from the server
+	sent := make(map[*Req]int)            // index of each request sent
+	queued := make(map[*Req]bool)         // requests passed to rpcnb successfully
+
+	go func() {
+		for i, r := range reqs {
+			if err := ctx.Err(); err != nil {
+				local <- Result{i, nil, err}
+				continue
+			}
+
+			if data, ok := clnt.local(r.Score, r.Btype, r.Count); ok {
+				local <- Result{i, data, nil}
+				continue
+			}
+
+			req, err := clnt.readReq(ctx, r.Score, r.Btype, r.Count)
+			if err != nil {
+				local <- Result{i, nil, err}
+				continue
+			}
+
+			req.Done = done
+			mu.Lock()
+			sent[req] = i
+			mu.Unlock()
+
+			err = clnt.rpcnb(ctx, req)
+			if err != nil {
+				mu.Lock()
+				delete(sent, req)
+				mu.Unlock()
+
+				clnt.ReqFree(req)
+				local <- Result{i, nil, err}
+				continue
+			}
+
+			// the collector may have cancelled the others already
+			mu.Lock()
+			_, ok := sent[req]
+			if ok {
+				// not received by the collector yet
+				queued[req] = true
+			}
+
+			ok = ok && ctx.Err() != nil && clnt.cancel(req)
+			if ok {
+				delete(sent, req)
+				delete(queued, req)
+			}
+			mu.Unlock()
+
+			if ok {
+				local <- Result{i, nil, ctx.Err()}
+			}
+		}
+	}()
+
+	go func() {
+		next := 0
+		pending := make(map[int]Result)
+		emit := func(r Result) {
+			if unordered {
+				out <- r
+				return
+			}
+
+			pending[r.Index] = r
+			for {
+				r, ok := pending[next]
+				if !ok {
+					break
+				}
+
+				delete(pending, next)
+				out <- r
+				next++
+			}
+		}
+
+		ctxdone := ctx.Done()
+		for n := 0; n < len(reqs); {
+			select {
+			case r := <-local:
+				emit(r)
+				n++
+
+			case req := <-done:
+				mu.Lock()
+				i := sent[req]
+				delete(sent, req)
+				delete(queued, req)
+				mu.Unlock()
+
+				r := Result{Index: i}
+				if req.Err != nil {
+					r.Err = req.Err
+					clnt.ReqFree(req)
+				} else {
+					r.Data, r.Err = clnt.readDone(req, reqs[i].Count)
+				}
+
+				emit(r)
+				n++
+
+			case <-ctxdone:
+				ctxdone = nil
+				mu.Lock()
+				for req, i := range sent {
+					if queued[req] && clnt.cancel(req) {
+						delete(sent, req)
+						delete(queued, req)
+						emit(Result{i, nil, ctx.Err()})
+						n++
+					}
+				}
+				mu.Unlock()
+			}
+		}
+
+		close(out)
+	}()
+
+	return out
+}
@@ -0,0 +1,216 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mischief/govt/vt"
+)
+
+// Requests are sent again at most MaxRetries times, even if the
+// interceptors ask for more.
+const MaxRetries = 8
+
+// Interceptor observes the requests sent by a client. The interceptors
+// added with Use are called in order before a request is sent, and in
+// reverse order after it completes. Each Send that succeeds is followed
+// by exactly one Done for the same attempt, also if the request fails
+// before it's sent, or is cancelled.
+type Interceptor interface {
+	// Called before the request is sent. If it returns an error, the
+	// request fails with it and is not sent. The Done methods of the
+	// interceptors whose Send already succeeded are called with the
+	// error in req.Err.
+	Send(req *Req) error
+
+	// Called when the request completes, with req.Rc set to the
+	// response, or req.Err to the error, and the time since the request
+	// was issued. If it returns true for a response from the server, the
+	// request is sent again, unless the context it was issued with is
+	// done, or it was already sent again MaxRetries times. Done is
+	// called from the client's receiving goroutine, so it shouldn't block.
+	Done(req *Req, d time.Duration) (retry bool)
+}
+
+// Adds interceptors to the client.
+func (clnt *Clnt) Use(ic ...Interceptor) {
+	clnt.Lock()
+	defer clnt.Unlock()
+
+	// copy, so that chain can return the slice without locking
+	ics := make([]Interceptor, 0, len(clnt.interceptors)+len(ic))
+	ics = append(ics, clnt.interceptors...)
+	clnt.interceptors = append(ics, ic...)
+}
+
+func (clnt *Clnt) chain() []Interceptor {
+	clnt.Lock()
+	defer clnt.Unlock()
+
+	return clnt.interceptors
+}
+
+func (clnt *Clnt) intercept(req *Req) error {
+	ics := clnt.chain()
+	req.start = time.Now()
+	for i, ic := range ics {
+		if err := ic.Send(req); err != nil {
+			req.Err = vtError(err)
+			d := time.Since(req.start)
+			for i--; i >= 0; i-- {
+				ics[i].Done(req, d)
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Calls the interceptors for the completed request. Returns true if
+// the request should be sent again.
+func (clnt *Clnt) complete(req *Req) (retry bool) {
+	ics := clnt.chain()
+	d := time.Since(req.start)
+	for i := len(ics) - 1; i >= 0; i-- {
+		if ics[i].Done(req, d) {
+			retry = true
+		}
+	}
+
+	return
+}
+
+// Sends the request again. The request keeps its place in the window.
+// Its context is checked before the retry, but it doesn't interrupt it,
+// the request's owner may cancel it like any other sent request.
+func (clnt *Clnt) retry(req *Req) {
+	req.Rc.Clear()
+	req.Err = nil
+	req.retries++
+
+	clnt.Lock()
+	req.admitted = true
+	req.wsize = len(req.Tc.Data)
+	clnt.wreqs++
+	clnt.wbytes += req.wsize
+	clnt.Unlock()
+
+	err := clnt.rpcnb(context.Background(), req)
+	if err != nil {
+		clnt.deliver(req, req.Done)
+	}
+}
+
+func vtError(err error) *vt.Error {
+	if verr, ok := err.(*vt.Error); ok {
+		return verr
+	}
+
+	return &vt.Error{err.Error()}
+}
+
+type logInterceptor struct {
+	l *log.Logger
+}
+
+// Returns an Interceptor that logs each completed request with its
+// response or error and latency. If l is nil, the standard logger is used.
+func LogInterceptor(l *log.Logger) Interceptor {
+	if l == nil {
+		l = log.Default()
+	}
+
+	return &logInterceptor{l}
+}
+
+func (li *logInterceptor) Send(req *Req) error {
+	return nil
+}
+
+func (li *logInterceptor) Done(req *Req, d time.Duration) bool {
+	switch {
+	case req.Err != nil:
+		li.l.Printf("%s %v: %v (%v)", req.Clnt.Id, &req.Tc, req.Err, d)
+	case req.Tc.Id == vt.Tgoodbye:
+		// there is no reply to a goodbye
+		li.l.Printf("%s %v (%v)", req.Clnt.Id, &req.Tc, d)
+	default:
+		li.l.Printf("%s %v: %v (%v)", req.Clnt.Id, &req.Tc, &req.Rc, d)
+	}
+
+	return false
+}
+
+// Default upper bounds of the Histogram buckets.
+var DefaultBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// Histogram is an Interceptor that counts the latencies of the requests
+// of each message type.
+type Histogram struct {
+	sync.Mutex
+	Buckets []time.Duration // upper bounds of the buckets, ascending
+	counts  map[uint8][]uint64
+}
+
+// Creates a Histogram with the specified bucket bounds, or DefaultBuckets
+// if there are none. Requests slower than the last bound are counted in
+// an extra bucket.
+func NewHistogram(buckets ...time.Duration) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	h := new(Histogram)
+	h.Buckets = buckets
+	h.counts = make(map[uint8][]uint64)
+
+	return h
+}
+
+func (h *Histogram) Send(req *Req) error {
+	return nil
+}
+
+func (h *Histogram) Done(req *Req, d time.Duration) bool {
+	i := 0
+	for i < len(h.Buckets) && d > h.Buckets[i] {
+		i++
+	}
+
+	h.Lock()
+	c := h.counts[req.Tc.Id]
+	if c == nil {
+		c = make([]uint64, len(h.Buckets)+1)
+		h.counts[req.Tc.Id] = c
+	}
+	c[i]++
+	h.Unlock()
+
+	return false
+}
+
+// Returns the counts of the requests with the specified message type
+// (vt.Tread, vt.Twrite, etc.) in each bucket.
+func (h *Histogram) Counts(id uint8) []uint64 {
+	h.Lock()
+	defer h.Unlock()
+
+	c := make([]uint64, len(h.Buckets)+1)
+	copy(c, h.counts[id])
+	return c
+}
@@ -0,0 +1,90 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"context"
+	"time"
+
+	"github.com/mischief/govt/vt"
+)
+
+// Set as the client's error if the server doesn't answer a keepalive ping.
+var ErrKeepalive = &vt.Error{"keepalive timeout"}
+
+// Pings the server. Returns the round-trip time.
+func (clnt *Clnt) Ping(ctx context.Context) (time.Duration, error) {
+	req, err := clnt.windowReq(ctx, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Tc.Id = vt.Tping
+	start := time.Now()
+	err = clnt.rpc(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+
+	rtt := time.Since(start)
+	clnt.ReqFree(req)
+	return rtt, nil
+}
+
+// Pings the server if nothing was received from it for interval. If the
+// server doesn't answer within timeout, the connection is considered
+// broken: it's closed, and the pending requests fail with ErrKeepalive,
+// unless the client reconnects. An interval of 0 stops the keepalive.
+func (clnt *Clnt) Keepalive(interval, timeout time.Duration) {
+	clnt.Lock()
+	if clnt.kastop != nil {
+		close(clnt.kastop)
+		clnt.kastop = nil
+	}
+
+	if interval > 0 {
+		clnt.kastop = make(chan struct{})
+		go clnt.keepalive(interval, timeout, clnt.kastop)
+	}
+	clnt.Unlock()
+}
+
+func (clnt *Clnt) keepalive(interval, timeout time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-clnt.stopped:
+			return
+
+		case <-t.C:
+		}
+
+		clnt.Lock()
+		idle := time.Since(clnt.lastrecv)
+		clnt.Unlock()
+		if idle < interval {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := clnt.Ping(ctx)
+		cancel()
+		if err != context.DeadlineExceeded {
+			continue
+		}
+
+		clnt.Lock()
+		if clnt.reconnect == nil && clnt.err == nil {
+			clnt.err = ErrKeepalive
+		}
+		clnt.conn.Close()
+		clnt.Unlock()
+	}
+}
@@ -4,6 +4,8 @@
 
 package vtclnt
 
+import "context"
+
 var m2id = [...]uint8{
 	0, 1, 0, 2, 0, 1, 0, 3,
 	0, 1, 0, 2, 0, 1, 0, 4,
@@ -42,12 +44,18 @@ var m2id = [...]uint8{
 func newPool(maxid uint32) *pool {
 	p := new(pool)
 	p.maxid = maxid
-	p.nchan = make(chan uint32)
 
 	return p
 }
 
 func (p *pool) getId() uint32 {
+	id, _ := p.getIdContext(context.Background())
+	return id
+}
+
+// Like getId, but gives up if the context is done while waiting for
+// an id to be freed.
+func (p *pool) getIdContext(ctx context.Context) (uint32, error) {
 	var n uint32 = 0
 	var ret uint32
 
@@ -69,26 +77,46 @@ func (p *pool) getId() uint32 {
 		p.imap = b
 	}
 
-	if n >= uint32(len(p.imap)) {
-		p.need++
-		p.Unlock()
-		ret = <-p.nchan
-	} else {
+	if n < uint32(len(p.imap)) {
 		ret = uint32(m2id[p.imap[n]])
 		p.imap[n] |= 1 << ret
 		ret += n * 8
 		p.Unlock()
+		return ret, nil
 	}
 
-	return ret
+	w := make(chan uint32, 1)
+	p.waiters = append(p.waiters, w)
+	p.Unlock()
+
+	select {
+	case ret = <-w:
+		return ret, nil
+
+	case <-ctx.Done():
+		p.Lock()
+		for i, c := range p.waiters {
+			if c == w {
+				p.waiters = append(p.waiters[:i], p.waiters[i+1:]...)
+				p.Unlock()
+				return 0, ctx.Err()
+			}
+		}
+		p.Unlock()
+
+		// an id was already passed to us
+		p.putId(<-w)
+		return 0, ctx.Err()
+	}
 }
 
 func (p *pool) putId(id uint32) {
 	p.Lock()
-	if p.need > 0 {
-		p.nchan <- id
-		p.need--
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
 		p.Unlock()
+		w <- id
 		return
 	}
 
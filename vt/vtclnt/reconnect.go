@@ -0,0 +1,220 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/mischief/govt/vt"
+)
+
+const (
+	DefaultMinDelay = 100 * time.Millisecond
+	DefaultMaxDelay = 30 * time.Second
+)
+
+// Reconnect controls how a client created by ConnectRetry reconnects
+// when the connection to the server is lost. The delay between the
+// attempts starts at MinDelay and doubles after each failed attempt,
+// up to MaxDelay. The zero values select the defaults.
+type Reconnect struct {
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	Attempts int // give up after that many failed attempts, 0 for never
+
+	// If not nil, Notify is called with attempt 0 and the error when the
+	// connection is lost, and after each reconnect attempt with the
+	// attempt number and its error, or nil if the client reconnected.
+	Notify func(clnt *Clnt, attempt int, err error)
+}
+
+// Connects to the server like Connect. When the connection is lost the
+// client dials the server again as specified by r, and sends again the
+// Tread, Twrite and Tsync requests that didn't get a response. The
+// pending requests fail only if the client gives up reconnecting.
+func ConnectRetry(ntype, addr string, r *Reconnect) (*Clnt, error) {
+	return connect(context.Background(), netDial(ntype, addr), retryConfig(r))
+}
+
+// Connects to the server over TLS like ConnectTLS, and reconnects like
+// ConnectRetry. The same config is used for each connection.
+func ConnectTLSRetry(addr string, config *tls.Config, r *Reconnect) (*Clnt, error) {
+	return connect(context.Background(), tlsDial(addr, config), retryConfig(r))
+}
+
+// Returns a copy of r with the defaults filled in.
+func retryConfig(r *Reconnect) *Reconnect {
+	rc := *r
+	if rc.MinDelay <= 0 {
+		rc.MinDelay = DefaultMinDelay
+	}
+
+	if rc.MaxDelay < rc.MinDelay {
+		rc.MaxDelay = DefaultMaxDelay
+		if rc.MaxDelay < rc.MinDelay {
+			rc.MaxDelay = rc.MinDelay
+		}
+	}
+
+	return &rc
+}
+
+func (clnt *Clnt) notify(attempt int, err error) {
+	if clnt.reconnect.Notify != nil {
+		clnt.reconnect.Notify(clnt, attempt, err)
+	}
+}
+
+// Dials the server until a connection is established, the number of
+// attempts is exhausted, or Hangup is called. Returns the Decoder for
+// the new connection, or nil if the client gave up.
+func (clnt *Clnt) redial(err *vt.Error) *vt.Decoder {
+	select {
+	case <-clnt.hangup:
+		// the connection was closed after the goodbye
+		return nil
+	default:
+	}
+
+	r := clnt.reconnect
+	clnt.notify(0, err)
+
+	delay := r.MinDelay
+	for attempt := 1; r.Attempts == 0 || attempt <= r.Attempts; attempt++ {
+		t := time.NewTimer(delay)
+		select {
+		case <-clnt.hangup:
+			t.Stop()
+			return nil
+		case <-t.C:
+		}
+
+		dec, e := clnt.reconnectConn()
+		if e == ErrClosed {
+			break
+		} else if e == nil {
+			clnt.notify(attempt, nil)
+			return dec
+		}
+
+		clnt.notify(attempt, e)
+		delay *= 2
+		if delay > r.MaxDelay {
+			delay = r.MaxDelay
+		}
+	}
+
+	return nil
+}
+
+// Establishes a new connection, sends the requests that didn't get a
+// response on the old one and starts the sending goroutine.
+func (clnt *Clnt) reconnectConn() (*vt.Decoder, error) {
+	var tc, rc vt.Call
+
+	c, err := clnt.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if processBanner(c) != clnt.version {
+		// the requests were prepared for the old version
+		c.Close()
+		return nil, vt.Eversion
+	}
+
+	dec := vt.NewDecoder(c, clnt.version)
+	enc := vt.NewEncoder(c, clnt.version)
+	clnt.hello(&tc)
+	err = enc.Encode(&tc)
+	if err == nil {
+		err = enc.Flush()
+	}
+
+	if err == nil {
+		err = dec.Decode(&rc)
+	}
+
+	if err == nil && rc.Id == vt.Rerror {
+		err = vt.ParseError(rc.Ename)
+	} else if err == nil && rc.Id != vt.Rhello {
+		err = &vt.Error{"invalid response"}
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	var resend, failed []*Req
+	var fdone []chan *Req
+
+	clnt.Lock()
+	if clnt.closing {
+		clnt.Unlock()
+		c.Close()
+		return nil, ErrClosed
+	}
+
+	clnt.conn = c
+	stale := clnt.stale
+	clnt.stale = nil
+
+	for r := clnt.reqfirst; r != nil; {
+		next := r.next
+		if r.sent {
+			switch r.Tc.Id {
+			case vt.Tread, vt.Twrite, vt.Tsync:
+				resend = append(resend, r)
+
+			default:
+				clnt.remove(r)
+				failed = append(failed, r)
+				fdone = append(fdone, r.Done)
+			}
+		}
+
+		r = next
+	}
+	clnt.Unlock()
+
+	for _, r := range stale {
+		// the responses will never arrive
+		r.Err = &vt.Error{"connection lost"}
+		clnt.complete(r)
+		clnt.ReqFree(r)
+	}
+
+	for i, r := range failed {
+		r.Err = &vt.Error{"connection lost"}
+		clnt.complete(r)
+		if fdone[i] != nil {
+			fdone[i] <- r
+		} else {
+			clnt.ReqFree(r)
+		}
+	}
+
+	for _, r := range resend {
+		err = enc.Encode(&r.Tc)
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = enc.Flush()
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	go clnt.send()
+	return dec, nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+)
+
+// Forwards the connections to a server and drops them on request.
+type proxy struct {
+	sync.Mutex
+	l     net.Listener
+	conns []net.Conn
+}
+
+// Starts a proxy to the server at addr. Returns it and its address.
+func startProxy(t *testing.T, addr string) (*proxy, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &proxy{l: l}
+	t.Cleanup(func() {
+		l.Close()
+		p.drop()
+	})
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			s, err := net.Dial("tcp", addr)
+			if err != nil {
+				c.Close()
+				continue
+			}
+
+			p.Lock()
+			p.conns = append(p.conns, c, s)
+			p.Unlock()
+			go io.Copy(c, s)
+			go io.Copy(s, c)
+		}
+	}()
+
+	return p, l.Addr().String()
+}
+
+// Closes the forwarded connections.
+func (p *proxy) drop() {
+	p.Lock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+
+	p.conns = nil
+	p.Unlock()
+}
+
+func block(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprint(i, " ")), 100)
+}
+
+// Writes and reads blocks while the connection is dropped repeatedly.
+func TestReconnect(t *testing.T) {
+	_, addr := startRam(t)
+	p, paddr := startProxy(t, addr)
+
+	var lost, reconnected int32
+	clnt, err := vtclnt.ConnectRetry("tcp", paddr, &vtclnt.Reconnect{
+		MinDelay: time.Millisecond,
+		MaxDelay: 10 * time.Millisecond,
+		Notify: func(clnt *vtclnt.Clnt, attempt int, err error) {
+			switch {
+			case attempt == 0:
+				atomic.AddInt32(&lost, 1)
+			case err == nil:
+				atomic.AddInt32(&reconnected, 1)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("ConnectRetry: %v", err)
+	}
+
+	defer clnt.Hangup()
+
+	const n = 200
+	scores := make([]vt.Score, n)
+	for i := 0; i < n; i++ {
+		if i%20 == 10 {
+			p.drop()
+		}
+
+		scores[i], err = clnt.Put(vt.DataBlock, block(i))
+		if err != nil {
+			t.Fatalf("Put %d: %v", i, err)
+		}
+	}
+
+	err = clnt.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		if i%20 == 10 {
+			p.drop()
+		}
+
+		data, err := clnt.Get(scores[i], vt.DataBlock, 8192)
+		if err != nil || !bytes.Equal(data, block(i)) {
+			t.Fatalf("Get %d: %q, %v", i, data, err)
+		}
+	}
+
+	if atomic.LoadInt32(&lost) == 0 || atomic.LoadInt32(&reconnected) != atomic.LoadInt32(&lost) {
+		t.Errorf("lost the connection %d times, reconnected %d times", lost, reconnected)
+	}
+}
+
+// Cancels reads while the server holds them, and checks that their late
+// responses don't go to the requests that reuse the tags.
+func TestCancel(t *testing.T) {
+	srv, addr := startRam(t)
+	clnt := connect(t, addr)
+
+	const n = 20
+	scores := make([]vt.Score, n)
+	for i := range scores {
+		var err error
+
+		scores[i], err = clnt.Put(vt.DataBlock, block(i))
+		if err != nil {
+			t.Fatalf("Put %d: %v", i, err)
+		}
+	}
+
+	release := srv.hold(scores[0])
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := clnt.GetContext(ctx, scores[0], vt.DataBlock, 8192)
+			if err != context.DeadlineExceeded {
+				t.Errorf("GetContext returned %v", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	errs := make(chan error, n)
+	for i := 1; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				data, err := clnt.Get(scores[i], vt.DataBlock, 8192)
+				if err != nil || !bytes.Equal(data, block(i)) {
+					errs <- fmt.Errorf("Get %d: %q, %v", i, data, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	data, err := clnt.Get(scores[0], vt.DataBlock, 8192)
+	if err != nil || !bytes.Equal(data, block(0)) {
+		t.Fatalf("Get after cancel: %q, %v", data, err)
+	}
+
+	if clnt.Pending() != 0 {
+		t.Errorf("%d requests pending", clnt.Pending())
+	}
+}
+
+// The server closing the connection after the goodbye must not make the
+// client reconnect.
+func TestHangupRetry(t *testing.T) {
+	_, addr := startRam(t)
+
+	var notified int32
+	clnt, err := vtclnt.ConnectRetry("tcp", addr, &vtclnt.Reconnect{
+		MinDelay: 2 * time.Second,
+		Notify: func(clnt *vtclnt.Clnt, attempt int, err error) {
+			atomic.AddInt32(&notified, 1)
+		},
+	})
+	if err != nil {
+		t.Fatalf("ConnectRetry: %v", err)
+	}
+
+	start := time.Now()
+	err = clnt.Hangup()
+	if err != nil {
+		t.Errorf("Hangup: %v", err)
+	}
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Hangup took %v", d)
+	}
+
+	if n := atomic.LoadInt32(&notified); n != 0 {
+		t.Errorf("Notify called %d times", n)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt_test
+
+import (
+	"crypto/sha1"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+	"github.com/mischief/govt/vt/vtsrv"
+)
+
+// A venti server keeping the blocks in memory.
+type ramSrv struct {
+	vtsrv.Srv
+	sync.Mutex
+	blocks map[vt.Score][]byte
+	btypes map[vt.Score]uint8
+	held   map[vt.Score]chan bool // reads of the score wait for the channel
+	delay  time.Duration          // delay of the writes
+	lie    bool                   // respond to writes with a wrong score
+}
+
+func (srv *ramSrv) Hello(req *vtsrv.Req) {
+	req.RespondHello("anonymous", 0, 0)
+}
+
+func (srv *ramSrv) Read(req *vtsrv.Req) {
+	srv.Lock()
+	data, ok := srv.blocks[req.Tc.Score]
+	btype := srv.btypes[req.Tc.Score]
+	held := srv.held[req.Tc.Score]
+	srv.Unlock()
+	if held != nil {
+		<-held
+	}
+
+	if !ok || btype != req.Tc.Btype {
+		req.RespondErr(vt.ErrNotFound)
+		return
+	}
+
+	if len(data) > int(req.Tc.Count) {
+		req.RespondErr(vt.ErrTooBig)
+		return
+	}
+
+	req.RespondRead(data)
+}
+
+func (srv *ramSrv) Write(req *vtsrv.Req) {
+	srv.Lock()
+	delay, lie := srv.delay, srv.lie
+	srv.Unlock()
+	time.Sleep(delay)
+
+	data := append([]byte(nil), req.Tc.Data...)
+	score := vt.Score(sha1.Sum(data))
+	srv.Lock()
+	srv.blocks[score] = data
+	srv.btypes[score] = req.Tc.Btype
+	srv.Unlock()
+	if lie {
+		score[0]++
+	}
+
+	req.RespondWrite(score)
+}
+
+// Returns true if the block is stored.
+func (srv *ramSrv) stored(score vt.Score) bool {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.blocks[score] != nil
+}
+
+// Delays the reads of the score until the returned function is called.
+func (srv *ramSrv) hold(score vt.Score) func() {
+	held := make(chan bool)
+	srv.Lock()
+	srv.held[score] = held
+	srv.Unlock()
+
+	return func() {
+		srv.Lock()
+		delete(srv.held, score)
+		srv.Unlock()
+		close(held)
+	}
+}
+
+// Returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// Waits until a server listens on addr.
+func waitListen(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("server on %s didn't start", addr)
+}
+
+// Starts a ramSrv. Returns it and its address.
+func startRam(t *testing.T) (*ramSrv, string) {
+	srv := &ramSrv{
+		blocks: make(map[vt.Score][]byte),
+		btypes: make(map[vt.Score]uint8),
+		held:   make(map[vt.Score]chan bool),
+	}
+
+	addr := freeAddr(t)
+	srv.Id = "ram"
+	srv.Start(srv)
+	go vtsrv.StartListener("tcp", addr, &srv.Srv)
+	waitListen(t, addr)
+	return srv, addr
+}
+
+// Connects to the server at addr and hangs up when the test ends.
+func connect(t *testing.T, addr string) *vtclnt.Clnt {
+	clnt, err := vtclnt.Connect("tcp", addr)
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	t.Cleanup(func() { clnt.Hangup() })
+	return clnt
+}
+
+// The score of the second entry ends with zeros, the server truncates
+// them and Get has to extend the block for the entry to unpack.
+func TestDirBlock(t *testing.T) {
+	_, addr := startRam(t)
+	clnt := connect(t, addr)
+
+	es := []vt.Entry{
+		{Gen: 1, Psize: 8192, Dsize: 8192, Flags: vt.EntryActive, Size: 100, Score: vt.Score{1, 2, 3}},
+		{Gen: 2, Psize: 8192, Dsize: 8192, Flags: vt.EntryActive | vt.EntryDir, Depth: 1, Size: 5000, Score: vt.Score{4, 5, 6}},
+	}
+
+	score, err := clnt.Put(vt.DirBlock, vt.PackEntries(es))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	err = clnt.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	data, err := clnt.Get(score, vt.DirBlock, 8192)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if len(data)%vt.Entrysize != 0 {
+		t.Errorf("read %d bytes, not a whole number of entries", len(data))
+	}
+
+	es2, verr := vt.UnpackEntries(data)
+	if verr != nil {
+		t.Fatalf("UnpackEntries: %v", verr)
+	}
+
+	if len(es2) != len(es) {
+		t.Fatalf("read %d entries, wrote %d", len(es2), len(es))
+	}
+
+	for i := range es {
+		if es2[i] != es[i] {
+			t.Errorf("entry %d: read %+v, wrote %+v", i, es2[i], es[i])
+		}
+	}
+
+	data, err = clnt.Get(vt.Zeroscore, vt.DirBlock, 8192)
+	if err != nil || len(data) != 0 {
+		t.Errorf("Get(Zeroscore) returned %d bytes, %v", len(data), err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mischief/govt/vt"
+)
+
+// number of request latencies kept for the percentiles
+const nlatency = 1024
+
+// Stats is a snapshot of the client's statistics.
+type Stats struct {
+	Nreqs       int            // number of requests sent
+	Sent        uint64         // total size of the T messages sent
+	Received    uint64         // total size of the R messages received
+	Pending     int            // number of requests waiting for a response
+	PendingData int            // size of the data in the pending requests
+	MaxPending  int            // maximum number of pending requests
+	Nreads      int            // number of reads from the connection
+	Nwrites     int            // number of writes to the connection
+	Calls       map[string]int // number of requests per message type
+
+	// Latency percentiles of the last requests
+	Latency50  time.Duration
+	Latency90  time.Duration
+	Latency99  time.Duration
+	LatencyMax time.Duration
+}
+
+var callNames = map[uint8]string{
+	vt.Tping:    "Tping",
+	vt.Thello:   "Thello",
+	vt.Tgoodbye: "Tgoodbye",
+	vt.Tread:    "Tread",
+	vt.Twrite:   "Twrite",
+	vt.Tsync:    "Tsync",
+}
+
+// Records the latency of a request. Should be called with clnt locked.
+func (clnt *Clnt) latency(d time.Duration) {
+	clnt.lat[clnt.nlat%nlatency] = d
+	clnt.nlat++
+}
+
+// Returns the client's statistics.
+func (clnt *Clnt) Stats() *Stats {
+	st := new(Stats)
+	st.Calls = make(map[string]int)
+	st.percentiles(clnt.addStats(st))
+
+	return st
+}
+
+// Adds the client's counters to st. Returns the latencies of the last
+// requests.
+func (clnt *Clnt) addStats(st *Stats) []time.Duration {
+	clnt.Lock()
+	defer clnt.Unlock()
+
+	st.Nreqs += clnt.nreqs
+	st.Sent += clnt.tsz
+	st.Received += clnt.rsz
+	st.Pending += clnt.npend
+	st.PendingData += clnt.pbytes
+	st.MaxPending += clnt.maxpend
+	st.Nreads += clnt.nreads
+	st.Nwrites += clnt.nwrites
+	for id, n := range clnt.ncalls {
+		if n != 0 {
+			st.Calls[callNames[uint8(id)]] += n
+		}
+	}
+
+	n := clnt.nlat
+	if n > nlatency {
+		n = nlatency
+	}
+
+	lat := make([]time.Duration, n)
+	copy(lat, clnt.lat[0:n])
+	return lat
+}
+
+// Sets the latency percentiles from the latencies.
+func (st *Stats) percentiles(lat []time.Duration) {
+	n := len(lat)
+	if n == 0 {
+		return
+	}
+
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	st.Latency50 = lat[n*50/100]
+	st.Latency90 = lat[n*90/100]
+	st.Latency99 = lat[n*99/100]
+	st.LatencyMax = lat[n-1]
+}
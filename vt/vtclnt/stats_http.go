@@ -0,0 +1,101 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+package vtclnt
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var mux sync.RWMutex
+var stat map[string]http.Handler
+
+// Serves the client statistics under /govt/clnt/ on mux, or on
+// http.DefaultServeMux if mux is nil, e.g. next to the server statistics
+// served by vtsrv's StartStatsServer. The statistics are not served
+// unless RegisterStats is called. Like http.Handle, it panics if it's
+// called twice with the same mux.
+func RegisterStats(mux *http.ServeMux) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+
+	mux.HandleFunc("/govt/clnt/", StatsHandler)
+}
+
+func register(s string, h http.Handler) {
+	mux.Lock()
+	if stat == nil {
+		stat = make(map[string]http.Handler)
+	}
+
+	if h == nil {
+		delete(stat, s)
+	} else {
+		stat[s] = h
+	}
+	mux.Unlock()
+}
+
+func (clnt *Clnt) statsRegister() {
+	register("/govt/clnt/"+clnt.Id, clnt)
+}
+
+// The Id may have changed since the client was registered.
+func (clnt *Clnt) statsUnregister() {
+	mux.Lock()
+	for s, h := range stat {
+		if h == http.Handler(clnt) {
+			delete(stat, s)
+		}
+	}
+	mux.Unlock()
+}
+
+func (clnt *Clnt) ServeHTTP(c http.ResponseWriter, r *http.Request) {
+	io.WriteString(c, fmt.Sprintf("<html><body><h1>Client %s</h1>", clnt.Id))
+	defer io.WriteString(c, "</body></html>")
+
+	st := clnt.Stats()
+	io.WriteString(c, "<h2>Statistics</h2>\n")
+	io.WriteString(c, fmt.Sprintf("<p>Number of requests: %d", st.Nreqs))
+	io.WriteString(c, fmt.Sprintf("<br>Sent %v bytes", st.Sent))
+	io.WriteString(c, fmt.Sprintf("<br>Received %v bytes", st.Received))
+	io.WriteString(c, fmt.Sprintf("<br>Pending requests: %d max %d", st.Pending, st.MaxPending))
+	io.WriteString(c, fmt.Sprintf("<br>Pending data: %d bytes", st.PendingData))
+	io.WriteString(c, fmt.Sprintf("<br>Number of reads: %d", st.Nreads))
+	io.WriteString(c, fmt.Sprintf("<br>Number of writes: %d", st.Nwrites))
+	io.WriteString(c, fmt.Sprintf("<br>Latency: 50%% %v 90%% %v 99%% %v max %v",
+		st.Latency50, st.Latency90, st.Latency99, st.LatencyMax))
+
+	names := make([]string, 0, len(st.Calls))
+	for name := range st.Calls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	io.WriteString(c, "<h2>Requests</h2><p>")
+	for _, name := range names {
+		io.WriteString(c, fmt.Sprintf("%s: %d<br>", name, st.Calls[name]))
+	}
+}
+
+func StatsHandler(c http.ResponseWriter, r *http.Request) {
+	mux.RLock()
+	if v, ok := stat[r.URL.Path]; ok {
+		v.ServeHTTP(c, r)
+	} else if r.URL.Path == "/govt/clnt/" {
+		io.WriteString(c, fmt.Sprintf("<html><body><br><h1>Clients: </h1><br>"))
+		for v := range stat {
+			io.WriteString(c, fmt.Sprintf("<a href='%s'>%s</a><br>", v, v))
+		}
+		io.WriteString(c, "</body></html>")
+	} else {
+		http.NotFound(c, r)
+	}
+	mux.RUnlock()
+}
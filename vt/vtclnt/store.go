@@ -0,0 +1,22 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import "github.com/mischief/govt/vt"
+
+// Store is the set of block operations provided by Clnt. Code that only
+// reads and writes blocks can depend on it instead of Clnt, and be
+// tested with vtclnttest.MemStore.
+type Store interface {
+	Get(score vt.Score, btype uint8, count uint32) ([]byte, error)
+	Put(btype uint8, data []byte) (vt.Score, error)
+	Sync() error
+	Close() error
+}
+
+var (
+	_ Store = (*Clnt)(nil)
+	_ Store = (*Pool)(nil)
+)
@@ -0,0 +1,166 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mischief/govt/vt/vtclnt"
+	"github.com/mischief/govt/vt/vtsrv"
+)
+
+type helloSrv struct {
+	vtsrv.Srv
+	subjects chan string
+}
+
+func (srv *helloSrv) Hello(req *vtsrv.Req) {
+	srv.subjects <- req.Conn.Subject()
+	req.RespondHello("anonymous", 0, 0)
+}
+
+var serial int64
+
+// Creates a certificate signed by parent, or a self-signed one if parent
+// is nil.
+func newCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"govt"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+
+	signer, signkey := tmpl, interface{}(key)
+	if parent != nil {
+		signer, signkey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Starts a TLS server requiring client certificates signed by ca.
+// Returns its address.
+func startTLS(t *testing.T, srv *helloSrv, ca tls.Certificate) string {
+	addr := freeAddr(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{newCert(t, "server", &ca)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+
+	srv.Id = "tls"
+	srv.subjects = make(chan string, 1)
+	srv.Start(srv)
+	go vtsrv.StartTLSListener("tcp", addr, &srv.Srv, config)
+	waitListen(t, addr)
+	return addr
+}
+
+func TestTLS(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	srv := new(helloSrv)
+	addr := startTLS(t, srv, ca)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	cert := newCert(t, "alice", &ca)
+	clnt, err := vtclnt.ConnectTLS(addr, &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatalf("ConnectTLS: %v", err)
+	}
+
+	if s := <-srv.subjects; s != cert.Leaf.Subject.String() {
+		t.Errorf("subject %q, want %q", s, cert.Leaf.Subject.String())
+	}
+
+	err = clnt.Hangup()
+	if err != nil {
+		t.Errorf("Hangup: %v", err)
+	}
+
+	clnt, err = vtclnt.ConnectTLS(addr, &tls.Config{RootCAs: roots})
+	if err == nil {
+		clnt.Hangup()
+		t.Fatal("client without a certificate connected")
+	}
+
+	select {
+	case s := <-srv.subjects:
+		t.Errorf("Hello from a client without a certificate: %q", s)
+	default:
+	}
+}
+
+// A client that connects and stays silent must not keep the server from
+// accepting others, and is dropped after the banner timeout.
+func TestTLSSilentClient(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	srv := new(helloSrv)
+	srv.BannerTimeout = 200 * time.Millisecond
+	addr := startTLS(t, srv, ca)
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	clnt, err := vtclnt.ConnectTLS(addr, &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{newCert(t, "bob", &ca)},
+	})
+	if err != nil {
+		t.Fatalf("ConnectTLS: %v", err)
+	}
+
+	<-srv.subjects
+	clnt.Hangup()
+
+	silent.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = silent.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("the silent client wasn't dropped")
+	}
+}
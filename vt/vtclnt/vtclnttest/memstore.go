@@ -0,0 +1,203 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package vtclnttest provides an in-memory vtclnt.Store for testing code
+// that uses vtclnt without a venti server.
+package vtclnttest
+
+import (
+	"crypto/sha1"
+	"sync"
+	"time"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+)
+
+type block struct {
+	btype uint8
+	data  []byte
+}
+
+// MemStore is a vtclnt.Store that keeps the blocks in memory. It behaves
+// like a Clnt connected to an empty server: blocks are zero-truncated and
+// stored under their SHA-1 score, reads must use the type the block was
+// written with, and errors from writes are returned by the next Sync.
+type MemStore struct {
+	sync.Mutex
+	blocks   map[vt.Score]*block
+	maxblock int
+	latency  time.Duration
+	errs     map[uint8]error
+	werr     error
+	closed   bool
+}
+
+var _ vtclnt.Store = (*MemStore)(nil)
+
+// Creates an empty MemStore accepting blocks up to vt.Maxblock04 bytes.
+func NewMemStore() *MemStore {
+	s := new(MemStore)
+	s.blocks = make(map[vt.Score]*block)
+	s.maxblock = vt.Maxblock04
+	s.errs = make(map[uint8]error)
+
+	return s
+}
+
+// Sets the maximum size of the blocks, vt.Maxblock for protocol
+// version 02.
+func (s *MemStore) SetMaxblock(n int) {
+	s.Lock()
+	s.maxblock = n
+	s.Unlock()
+}
+
+// Sets a delay added to each operation.
+func (s *MemStore) SetLatency(d time.Duration) {
+	s.Lock()
+	s.latency = d
+	s.Unlock()
+}
+
+// Makes the operations with the specified message type (vt.Tread,
+// vt.Twrite or vt.Tsync) fail with err, until it's cleared by calling
+// SetError with a nil err. Failed writes don't store the block, and
+// like with Clnt, their errors are returned by Sync.
+func (s *MemStore) SetError(id uint8, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err == nil {
+		delete(s.errs, id)
+	} else {
+		s.errs[id] = err
+	}
+}
+
+// Waits for the latency and returns the error to inject, if any.
+func (s *MemStore) start(id uint8) error {
+	s.Lock()
+	d, err := s.latency, s.errs[id]
+	if s.closed {
+		err = vtclnt.ErrClosed
+	}
+	s.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+
+	return err
+}
+
+// Reads a block, zero-extended like vtclnt.Clnt.Get does. Returns
+// vt.ErrNotFound if there is no block with the score and type, and
+// vt.ErrTooBig if the block is larger than count.
+func (s *MemStore) Get(score vt.Score, btype uint8, count uint32) ([]byte, error) {
+	if !vt.CheckType(btype) {
+		return nil, vt.ErrBadType
+	}
+
+	err := s.start(vt.Tread)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if score != vt.Zeroscore {
+		s.Lock()
+		b := s.blocks[score]
+		s.Unlock()
+		if b == nil || b.btype != btype {
+			return nil, vt.ErrNotFound
+		}
+
+		if len(b.data) > int(count) {
+			return nil, vt.ErrTooBig
+		}
+
+		data = append([]byte(nil), b.data...)
+	}
+
+	data = vt.ZeroExtend(btype, data, vt.ExtendSize(btype, len(data), int(count)))
+
+	return data, nil
+}
+
+// Stores a block and returns its score. Empty blocks are not stored,
+// their score is vt.Zeroscore.
+func (s *MemStore) Put(btype uint8, data []byte) (vt.Score, error) {
+	if !vt.CheckType(btype) {
+		return vt.Score{}, vt.ErrBadType
+	}
+
+	data = vt.ZeroTruncate(btype, data)
+	if len(data) == 0 {
+		return vt.Zeroscore, nil
+	}
+
+	s.Lock()
+	max := s.maxblock
+	s.Unlock()
+	if len(data) > max {
+		return vt.Score{}, vt.ErrTooBig
+	}
+
+	score := vt.Score(sha1.Sum(data))
+	err := s.start(vt.Twrite)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err == vtclnt.ErrClosed {
+		return vt.Score{}, err
+	} else if err != nil {
+		if s.werr == nil {
+			s.werr = err
+		}
+	} else if s.blocks[score] == nil {
+		s.blocks[score] = &block{btype, append([]byte(nil), data...)}
+	}
+
+	return score, nil
+}
+
+// Returns the first error from the Puts since the previous Sync.
+func (s *MemStore) Sync() error {
+	err := s.start(vt.Tsync)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if err == vtclnt.ErrClosed {
+		return err
+	}
+
+	if err == nil {
+		err = s.werr
+	}
+
+	s.werr = nil
+	return err
+}
+
+// Closes the store. The following operations fail with vtclnt.ErrClosed.
+func (s *MemStore) Close() error {
+	err := s.Sync()
+
+	s.Lock()
+	s.closed = true
+	s.Unlock()
+
+	return err
+}
+
+// Returns the number of blocks stored.
+func (s *MemStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.blocks)
+}
@@ -0,0 +1,153 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnttest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+)
+
+func TestMemStoreTypes(t *testing.T) {
+	s := NewMemStore()
+
+	// truncated to the first score
+	ptrs := make([]byte, 3*vt.Scoresize)
+	ptrs[0] = 1
+	copy(ptrs[vt.Scoresize:], vt.Zeroscore[:])
+	copy(ptrs[2*vt.Scoresize:], vt.Zeroscore[:])
+	score, err := s.Put(vt.DataBlock+1, ptrs)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	data, err := s.Get(score, vt.DataBlock+1, 4*vt.Scoresize)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if len(data) != 4*vt.Scoresize || !bytes.Equal(data[0:3*vt.Scoresize], ptrs) ||
+		vt.Score(data[3*vt.Scoresize:]) != vt.Zeroscore {
+		t.Errorf("pointer block not zero-extended: %x", data)
+	}
+
+	if _, err := s.Get(score, vt.DataBlock, 8192); err != vt.ErrNotFound {
+		t.Errorf("Get with the wrong type returned %v", err)
+	}
+
+	if _, err := s.Get(score, vt.DataBlock+1, 10); err != vt.ErrTooBig {
+		t.Errorf("Get with a short count returned %v", err)
+	}
+
+	if _, err := s.Get(score, vt.RBlock+1, 8192); err != vt.ErrBadType {
+		t.Errorf("Get with an invalid type returned %v", err)
+	}
+
+	if _, err := s.Put(vt.RBlock+1, []byte("x")); err != vt.ErrBadType {
+		t.Errorf("Put with an invalid type returned %v", err)
+	}
+
+	score, err = s.Put(vt.DataBlock, make([]byte, 100))
+	if err != nil || score != vt.Zeroscore || s.Len() != 1 {
+		t.Errorf("Put of zeros returned %v, %v, %d blocks", score, err, s.Len())
+	}
+
+	s.SetMaxblock(10)
+	if _, err := s.Put(vt.DataBlock, bytes.Repeat([]byte("x"), 11)); err != vt.ErrTooBig {
+		t.Errorf("Put of a big block returned %v", err)
+	}
+}
+
+func TestMemStoreErrors(t *testing.T) {
+	s := NewMemStore()
+	ebad := &vt.Error{"injected"}
+
+	s.SetError(vt.Twrite, ebad)
+	score, err := s.Put(vt.DataBlock, []byte("data"))
+	if err != nil {
+		t.Fatalf("Put returned %v, write errors are for Sync", err)
+	}
+
+	if err := s.Sync(); err != ebad {
+		t.Errorf("Sync returned %v, expected %v", err, ebad)
+	}
+
+	if err := s.Sync(); err != nil {
+		t.Errorf("second Sync returned %v", err)
+	}
+
+	if _, err := s.Get(score, vt.DataBlock, 8192); err != vt.ErrNotFound {
+		t.Errorf("failed write stored the block: %v", err)
+	}
+
+	s.SetError(vt.Twrite, nil)
+	if _, err := s.Put(vt.DataBlock, []byte("data")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	s.SetError(vt.Tread, ebad)
+	if _, err := s.Get(score, vt.DataBlock, 8192); err != ebad {
+		t.Errorf("Get returned %v, expected %v", err, ebad)
+	}
+
+	s.SetError(vt.Tread, nil)
+	data, err := s.Get(score, vt.DataBlock, 8192)
+	if err != nil || !bytes.Equal(data, []byte("data")) {
+		t.Errorf("Get: %q, %v", data, err)
+	}
+
+	s.SetError(vt.Tsync, ebad)
+	if err := s.Sync(); err != ebad {
+		t.Errorf("Sync returned %v, expected %v", err, ebad)
+	}
+
+	s.SetError(vt.Tsync, nil)
+	if err := s.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if _, err := s.Get(score, vt.DataBlock, 8192); err != vtclnt.ErrClosed {
+		t.Errorf("Get after Close returned %v", err)
+	}
+
+	if _, err := s.Put(vt.DataBlock, []byte("more")); err != vtclnt.ErrClosed {
+		t.Errorf("Put after Close returned %v", err)
+	}
+}
+
+func TestMemStoreLatency(t *testing.T) {
+	const d = 20 * time.Millisecond
+
+	s := NewMemStore()
+	s.SetLatency(d)
+
+	start := time.Now()
+	score, err := s.Put(vt.DataBlock, []byte("data"))
+	if err == nil {
+		_, err = s.Get(score, vt.DataBlock, 8192)
+	}
+
+	if err == nil {
+		err = s.Sync()
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := time.Since(start); e < 3*d {
+		t.Errorf("three operations took %v with a latency of %v", e, d)
+	}
+
+	s.SetLatency(0)
+	start = time.Now()
+	s.Get(score, vt.DataBlock, 8192)
+	if e := time.Since(start); e >= d {
+		t.Errorf("Get took %v without latency", e)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtclnt
+
+import "context"
+
+// Limits the requests waiting for a response to maxreqs requests, with
+// at most maxbytes bytes of written data. Zero means no limit, which is
+// the default. Requests that would exceed the limits wait until the
+// server responds to the earlier ones, before they take one of the
+// client's tags. A single block bigger than maxbytes is allowed when
+// no other data is pending.
+func (clnt *Clnt) SetWindow(maxreqs, maxbytes int) {
+	clnt.Lock()
+	clnt.maxreqs = maxreqs
+	clnt.maxbytes = maxbytes
+	clnt.wake()
+	clnt.Unlock()
+}
+
+// Returns the number of requests and the size of the data currently
+// in the window.
+func (clnt *Clnt) Window() (reqs, bytes int) {
+	clnt.Lock()
+	defer clnt.Unlock()
+
+	return clnt.wreqs, clnt.wbytes
+}
+
+// Allocates a request after waiting for room for size bytes of data in
+// the window, so that the callers waiting for the window don't hold tags.
+func (clnt *Clnt) windowReq(ctx context.Context, size int) (*Req, error) {
+	clnt.Lock()
+	err := clnt.wait(ctx, size)
+	clnt.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := clnt.reqAlloc(ctx)
+	if err != nil {
+		clnt.Lock()
+		clnt.release(size)
+		clnt.Unlock()
+		return nil, err
+	}
+
+	req.admitted = true
+	req.wsize = size
+	return req, nil
+}
+
+// Waits until a request with size bytes of data fits in the window, and
+// reserves room for it. Should be called with clnt locked, returns with
+// clnt locked.
+func (clnt *Clnt) wait(ctx context.Context, size int) error {
+	for {
+		if clnt.err != nil {
+			return clnt.err
+		}
+
+		full := clnt.maxreqs > 0 && clnt.wreqs >= clnt.maxreqs
+		full = full || clnt.maxbytes > 0 && clnt.wbytes > 0 && clnt.wbytes+size > clnt.maxbytes
+		if !full {
+			clnt.wreqs++
+			clnt.wbytes += size
+			return nil
+		}
+
+		if clnt.wchan == nil {
+			clnt.wchan = make(chan struct{})
+		}
+
+		c := clnt.wchan
+		clnt.Unlock()
+		select {
+		case <-c:
+		case <-clnt.stopped:
+		case <-ctx.Done():
+			clnt.Lock()
+			return ctx.Err()
+		}
+		clnt.Lock()
+	}
+}
+
+// Removes the request from the window, if it's in it. Should be called
+// with clnt locked.
+func (clnt *Clnt) leave(r *Req) {
+	if r.admitted {
+		r.admitted = false
+		clnt.release(r.wsize)
+	}
+}
+
+// Releases the room reserved by wait. Should be called with clnt locked.
+func (clnt *Clnt) release(size int) {
+	clnt.wreqs--
+	clnt.wbytes -= size
+	clnt.wake()
+}
+
+// Wakes up the requests waiting for room in the window. Should be
+// called with clnt locked.
+func (clnt *Clnt) wake() {
+	if clnt.wchan != nil {
+		close(clnt.wchan)
+		clnt.wchan = nil
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtfile_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+	"github.com/mischief/govt/vt/vtclnt/vtclnttest"
+	"github.com/mischief/govt/vt/vtfile"
+	"github.com/mischief/govt/vt/vtsrv"
+)
+
+// A venti server keeping the blocks in memory.
+type ramSrv struct {
+	vtsrv.Srv
+	sync.Mutex
+	blocks map[vt.Score][]byte
+}
+
+func (srv *ramSrv) Hello(req *vtsrv.Req) {
+	req.RespondHello("anonymous", 0, 0)
+}
+
+func (srv *ramSrv) Read(req *vtsrv.Req) {
+	srv.Lock()
+	data, ok := srv.blocks[req.Tc.Score]
+	srv.Unlock()
+	if !ok {
+		req.RespondErr(vt.ErrNotFound)
+		return
+	}
+
+	req.RespondRead(data)
+}
+
+func (srv *ramSrv) Write(req *vtsrv.Req) {
+	data := append([]byte(nil), req.Tc.Data...)
+	score := vt.Score(sha1.Sum(data))
+	srv.Lock()
+	srv.blocks[score] = data
+	srv.Unlock()
+	req.RespondWrite(score)
+}
+
+// Starts a ramSrv and connects to it.
+func connect(t *testing.T) *vtclnt.Clnt {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := &ramSrv{blocks: make(map[vt.Score][]byte)}
+	srv.Id = "ram"
+	srv.Start(srv)
+	go vtsrv.StartListener("tcp", addr, &srv.Srv)
+
+	for i := 0; i < 100; i++ {
+		clnt, err := vtclnt.Connect("tcp", addr)
+		if err == nil {
+			t.Cleanup(func() { clnt.Hangup() })
+			return clnt
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("server didn't start")
+	return nil
+}
+
+func TestFile(t *testing.T) {
+	testFile(t, connect(t))
+}
+
+// The Reader can't prefetch from a MemStore.
+func TestFileMemStore(t *testing.T) {
+	testFile(t, vtclnttest.NewMemStore())
+}
+
+// Writes trees of depth 0 to 3 with two scores per pointer block and
+// reads them back sequentially and at random offsets.
+func testFile(t *testing.T, store vtclnt.Store) {
+	const psize, dsize = 2 * vt.Scoresize, 64
+
+	rnd := rand.New(rand.NewSource(1))
+	tests := []struct {
+		size  int
+		depth uint8
+	}{
+		{0, 0}, {10, 0}, {dsize, 0}, {dsize + 1, 1}, {2 * dsize, 1},
+		{3 * dsize, 2}, {4 * dsize, 2}, {5*dsize - 7, 3}, {8 * dsize, 3},
+	}
+
+	for _, test := range tests {
+		data := make([]byte, test.size)
+		rnd.Read(data)
+		if test.size > 2*dsize {
+			// a block of zeros is stored as Zeroscore
+			copy(data[dsize:2*dsize], make([]byte, dsize))
+		}
+
+		w, err := vtfile.NewWriter(store, vt.DataBlock, psize, dsize)
+		if err != nil {
+			t.Fatalf("NewWriter: %v", err)
+		}
+
+		n, err := w.Write(data)
+		if err != nil || n != len(data) {
+			t.Fatalf("size %d: Write returned %d, %v", test.size, n, err)
+		}
+
+		err = w.Close()
+		if err != nil {
+			t.Fatalf("size %d: Close: %v", test.size, err)
+		}
+
+		e := w.Entry()
+		if e.Depth != test.depth || e.Size != uint64(test.size) {
+			t.Fatalf("size %d: entry depth %d size %d, expected depth %d", test.size, e.Depth, e.Size, test.depth)
+		}
+
+		r, err := vtfile.NewReader(store, e)
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+
+		rdata, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(rdata, data) {
+			t.Fatalf("size %d: read %d bytes, %v", test.size, len(rdata), err)
+		}
+
+		for i := 0; i < 20 && test.size > 0; i++ {
+			off := rnd.Intn(test.size)
+			buf := make([]byte, rnd.Intn(2*dsize)+1)
+			n, err := r.ReadAt(buf, int64(off))
+			if n != len(buf) && err != io.EOF || !bytes.Equal(buf[0:n], data[off:off+n]) {
+				t.Fatalf("size %d: ReadAt %d at %d returned %d, %v", test.size, len(buf), off, n, err)
+			}
+		}
+
+		if _, err := r.Seek(-1, io.SeekEnd); test.size > 0 && err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+
+		rdata, err = io.ReadAll(r)
+		if test.size > 0 && (err != nil || !bytes.Equal(rdata, data[test.size-1:])) {
+			t.Fatalf("size %d: read %v after Seek, %v", test.size, rdata, err)
+		}
+
+		r.Close()
+	}
+}
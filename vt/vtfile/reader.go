@@ -0,0 +1,259 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vtfile
+
+import (
+	"io"
+	"sync"
+
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+)
+
+// Number of sibling data blocks requested ahead of the one being read.
+var DefaultPrefetch = 16
+
+var Eoffset *vt.Error = &vt.Error{"invalid offset"}
+var Ewhence *vt.Error = &vt.Error{"invalid whence"}
+
+// Reader reads the data of a hash tree described by an entry. Only the
+// pointer blocks on the path to the requested data are retrieved.
+type Reader struct {
+	sync.Mutex
+	Prefetch int
+
+	store  vtclnt.Store
+	clnt   Client // nil if the store can't prefetch
+	entry  vt.Entry
+	btype  uint8
+	fanout uint64
+	pos    int64
+	ptrs   []ptrblock                  // last pointer block read on each level
+	pend   map[uint64]chan *vtclnt.Req // data blocks requested in advance
+}
+
+type ptrblock struct {
+	valid bool
+	score vt.Score
+	data  []byte
+}
+
+// Creates a Reader for the tree described by the entry. Data blocks are
+// prefetched only if the store implements Client.
+func NewReader(store vtclnt.Store, e *vt.Entry) (*Reader, error) {
+	if e.Psize < 2*vt.Scoresize || e.Dsize == 0 || e.Depth > maxDepth {
+		return nil, Ebsize
+	}
+
+	r := new(Reader)
+	r.Prefetch = DefaultPrefetch
+	r.store = store
+	r.clnt, _ = store.(Client)
+	r.entry = *e
+	r.btype = e.Type() - e.Depth
+	r.fanout = uint64(e.Psize) / vt.Scoresize
+	r.ptrs = make([]ptrblock, e.Depth)
+	r.pend = make(map[uint64]chan *vtclnt.Req)
+
+	return r, nil
+}
+
+// Returns the size of the data.
+func (r *Reader) Size() int64 {
+	return int64(r.entry.Size)
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, Eoffset
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	size := r.entry.Size
+	dsize := uint64(r.entry.Dsize)
+	for n < len(p) && uint64(off) < size {
+		o := uint64(off)
+		bn := o / dsize
+		boff := o % dsize
+		m := dsize - boff
+		if m > uint64(len(p)-n) {
+			m = uint64(len(p) - n)
+		}
+
+		if m > size-o {
+			m = size - o
+		}
+
+		data, err := r.block(bn)
+		if err != nil {
+			return n, err
+		}
+
+		b := p[n : n+int(m)]
+		k := 0
+		if boff < uint64(len(data)) {
+			k = copy(b, data[boff:])
+		}
+
+		// the block was zero-truncated
+		for ; k < len(b); k++ {
+			b[k] = 0
+		}
+
+		n += int(m)
+		off += int64(m)
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
+
+func (r *Reader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	return
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	default:
+		return r.pos, Ewhence
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(r.entry.Size)
+	}
+
+	if offset < 0 {
+		return r.pos, Eoffset
+	}
+
+	r.pos = offset
+	return offset, nil
+}
+
+// Waits for the outstanding prefetch requests to finish.
+func (r *Reader) Close() error {
+	r.Lock()
+	for bn := range r.pend {
+		r.cancel(bn)
+	}
+	r.Unlock()
+
+	return nil
+}
+
+// Returns the content of the data block with the specified index.
+// Blocks not present in the tree are returned as nil.
+func (r *Reader) block(bn uint64) ([]byte, error) {
+	// drop the blocks we are not going to read
+	for n := range r.pend {
+		if n < bn || n > bn+uint64(r.Prefetch) {
+			r.cancel(n)
+		}
+	}
+
+	score, idx, err := r.walk(bn)
+	if err != nil || score == vt.Zeroscore {
+		return nil, err
+	}
+
+	if r.entry.Depth > 0 && r.clnt != nil {
+		r.prefetch(bn, idx)
+	}
+
+	if c, ok := r.pend[bn]; ok {
+		delete(r.pend, bn)
+		req := <-c
+		data := req.Rc.Data
+		if req.Err != nil {
+			err = req.Err
+		} else {
+			err = r.clnt.Verify(score, r.btype, data)
+		}
+
+		r.clnt.ReqFree(req)
+		return data, err
+	}
+
+	return r.store.Get(score, r.btype, uint32(r.entry.Dsize))
+}
+
+// Walks the pointer blocks from the root to the data block. Returns
+// its score and index within the lowest pointer block. Data blocks
+// not present in the tree have Zeroscore.
+func (r *Reader) walk(bn uint64) (score vt.Score, idx uint64, err error) {
+	score = r.entry.Score
+	for l := int(r.entry.Depth); l > 0; l-- {
+		p := &r.ptrs[l-1]
+		if !p.valid || p.score != score {
+			p.data, err = r.store.Get(score, r.btype+uint8(l), uint32(r.entry.Psize))
+			if err != nil {
+				p.valid = false
+				return vt.Score{}, 0, err
+			}
+
+			p.valid = true
+			p.score = score
+		}
+
+		n := bn
+		for i := 1; i < l; i++ {
+			n /= r.fanout
+		}
+
+		idx = n % r.fanout
+		if (idx+1)*vt.Scoresize > uint64(len(p.data)) {
+			return vt.Zeroscore, 0, nil
+		}
+
+		score = vt.Score(p.data[idx*vt.Scoresize : (idx+1)*vt.Scoresize])
+	}
+
+	return
+}
+
+// Sends read requests for the siblings following the data block
+// without waiting for the responses.
+func (r *Reader) prefetch(bn, idx uint64) {
+	p := r.ptrs[0].data
+	nblks := (r.entry.Size + uint64(r.entry.Dsize) - 1) / uint64(r.entry.Dsize)
+	for i := uint64(1); i <= uint64(r.Prefetch); i++ {
+		n := bn + i
+		j := idx + i
+		if n >= nblks || (j+1)*vt.Scoresize > uint64(len(p)) {
+			break
+		}
+
+		if _, ok := r.pend[n]; ok {
+			continue
+		}
+
+		score := vt.Score(p[j*vt.Scoresize : (j+1)*vt.Scoresize])
+		if score == vt.Zeroscore {
+			continue
+		}
+
+		// buffered, so the client doesn't block if nobody reads it
+		c := make(chan *vtclnt.Req, 1)
+		if r.clnt.Getnb(score, r.btype, uint32(r.entry.Dsize), c) != nil {
+			break
+		}
+
+		r.pend[n] = c
+	}
+}
+
+func (r *Reader) cancel(bn uint64) {
+	req := <-r.pend[bn]
+	delete(r.pend, bn)
+	r.clnt.ReqFree(req)
+}
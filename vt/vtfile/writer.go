@@ -0,0 +1,201 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The vtfile package stores and retrieves data bigger than a single
+// block as venti hash trees. The leaves of the tree are data (or
+// directory) blocks, the inner nodes are pointer blocks holding the
+// scores of the blocks one level below.
+package vtfile
+
+import (
+	"github.com/mischief/govt/vt"
+	"github.com/mischief/govt/vt/vtclnt"
+)
+
+const (
+	DefaultPsize = 8 * 1024
+	DefaultDsize = 8 * 1024
+
+	maxDepth = 7
+)
+
+var Eclosed *vt.Error = &vt.Error{"file closed"}
+var Ebsize *vt.Error = &vt.Error{"invalid block size"}
+var Etoobig *vt.Error = &vt.Error{"file too big"}
+
+// Client is the part of the venti client API a Reader uses to prefetch
+// data blocks. It is implemented by *vtclnt.Clnt and *vtclnt.Pool. Stores
+// that don't implement it, like vtclnttest.MemStore, can't send requests
+// without waiting for them, and are read one block at a time.
+type Client interface {
+	vtclnt.Store
+	Getnb(score vt.Score, btype uint8, count uint32, done chan *vtclnt.Req) error
+	ReqFree(req *vtclnt.Req)
+	Verify(score vt.Score, btype uint8, data []byte) error
+}
+
+// Writer cuts the data written to it into blocks and stores them
+// on a venti server. The score of the tree's root is available
+// after the Writer is closed.
+type Writer struct {
+	clnt   vtclnt.Store
+	btype  uint8
+	psize  int
+	dsize  int
+	buf    []byte   // current data block
+	levels [][]byte // current pointer block for each level
+	entry  vt.Entry
+	closed bool
+	err    error
+}
+
+// Creates a new Writer. The btype should be vt.DataBlock for files and
+// vt.DirBlock for directories. The dsize of directories is rounded down
+// to a multiple of vt.Entrysize.
+func NewWriter(clnt vtclnt.Store, btype uint8, psize, dsize int) (*Writer, error) {
+	if btype != vt.DataBlock && btype != vt.DirBlock {
+		return nil, vt.Eblktype
+	}
+
+	if btype == vt.DirBlock {
+		dsize -= dsize % vt.Entrysize
+	}
+
+	if psize < 2*vt.Scoresize || psize > vt.Maxblock || dsize <= 0 || dsize > vt.Maxblock {
+		return nil, Ebsize
+	}
+
+	w := new(Writer)
+	w.clnt = clnt
+	w.btype = btype
+	w.psize = psize - psize%vt.Scoresize
+	w.dsize = dsize
+	w.buf = make([]byte, 0, dsize)
+	w.entry.Psize = uint16(psize)
+	w.entry.Dsize = uint16(dsize)
+	w.entry.Flags = vt.EntryActive
+	if btype == vt.DirBlock {
+		w.entry.Flags |= vt.EntryDir
+	}
+
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	if w.closed {
+		return 0, Eclosed
+	}
+
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+
+		m := w.dsize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+
+		w.buf = append(w.buf, p[0:m]...)
+		p = p[m:]
+		n += m
+		if len(w.buf) == w.dsize {
+			w.flush()
+		}
+	}
+
+	return n, w.err
+}
+
+// Stores the remaining data and pointer blocks, and waits for the
+// server to acknowledge all of them.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+
+	w.closed = true
+	if len(w.buf) > 0 {
+		w.flush()
+	}
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(w.levels) == 0 {
+		// nothing was written
+		w.entry.Score = vt.Zeroscore
+		return nil
+	}
+
+	for i := 0; i < len(w.levels); i++ {
+		top := i == len(w.levels)-1
+		if top && len(w.levels[i]) == vt.Scoresize {
+			w.entry.Depth = uint8(i)
+			w.entry.Score = vt.Score(w.levels[i])
+			break
+		}
+
+		if len(w.levels[i]) > 0 {
+			w.flushLevel(i)
+		}
+	}
+
+	if w.err != nil {
+		return w.err
+	}
+
+	w.err = w.clnt.Sync()
+	return w.err
+}
+
+// Returns the entry describing the stored tree. Valid after Close.
+func (w *Writer) Entry() *vt.Entry {
+	return &w.entry
+}
+
+// Returns the score of the tree's root block. Valid after Close.
+func (w *Writer) Score() vt.Score {
+	return w.entry.Score
+}
+
+func (w *Writer) flush() {
+	score, err := w.clnt.Put(w.btype, w.buf)
+	if err != nil {
+		w.err = err
+		return
+	}
+
+	w.entry.Size += uint64(len(w.buf))
+	w.buf = make([]byte, 0, w.dsize)
+	w.addScore(0, score)
+}
+
+func (w *Writer) flushLevel(i int) {
+	if i+1 > maxDepth {
+		w.err = Etoobig
+		return
+	}
+
+	score, err := w.clnt.Put(w.btype+uint8(i)+1, w.levels[i])
+	if err != nil {
+		w.err = err
+		return
+	}
+
+	w.levels[i] = make([]byte, 0, w.psize)
+	w.addScore(i+1, score)
+}
+
+func (w *Writer) addScore(i int, score vt.Score) {
+	if i >= len(w.levels) {
+		w.levels = append(w.levels, make([]byte, 0, w.psize))
+	}
+
+	w.levels[i] = append(w.levels[i], score[:]...)
+	if len(w.levels[i]) == w.psize {
+		w.flushLevel(i)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"crypto/sha1"
 	"flag"
 	"fmt"
-	"hash"
 	"log"
 	"os"
 
@@ -22,50 +21,19 @@ import (
 type Grande struct {
 	vtsrv.Srv
 	topDir string
-	schan  chan hash.Hash
 }
 
 var addr = flag.String("addr", ":17034", "network address")
 var debug = flag.Int("debug", 0, "print debug messages")
 
-func eqscore(s1, s2 vt.Score) bool {
-	for i := 0; i < vt.Scoresize; i++ {
-		if s1[i] != s2[i] {
-			return false
-		}
-	}
-
-	return true
-}
-
 func (srv *Grande) Name(s vt.Score) string {
 	return fmt.Sprintf("%s/%02x/%02x/%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x",
 		srv.topDir, s[0], s[1], s[2], s[3], s[4], s[5], s[6], s[7], s[8], s[9], s[10],
 		s[11], s[12], s[13], s[14], s[15], s[16], s[17], s[18], s[19])
 }
 
-func (srv *Grande) init() {
-	srv.schan = make(chan hash.Hash, 32)
-}
-
-func (srv *Grande) calcScore(data []byte) (ret vt.Score) {
-	var s1 hash.Hash
-
-	select {
-	default:
-		s1 = sha1.New()
-	case s1 = <-srv.schan:
-		s1.Reset()
-	}
-
-	s1.Write(data)
-	ret = s1.Sum(nil)
-	select {
-	case srv.schan <- s1:
-		break
-	default:
-	}
-	return
+func (srv *Grande) calcScore(data []byte) vt.Score {
+	return vt.Score(sha1.Sum(data))
 }
 
 func (srv *Grande) Hello(req *vtsrv.Req) {
@@ -78,7 +46,11 @@ func (srv *Grande) Read(req *vtsrv.Req) {
 	bname := srv.Name(req.Tc.Score)
 	f, err := os.Open(bname)
 	if err != nil {
-		req.RespondError(err.Error())
+		if os.IsNotExist(err) {
+			req.RespondErr(vt.ErrNotFound)
+		} else {
+			req.RespondErr(err)
+		}
 		return
 	}
 
@@ -134,7 +106,6 @@ func main() {
 	}
 
 	srv := new(Grande)
-	srv.init()
 	srv.topDir = flag.Arg(0)
 	srv.Debuglevel = *debug
 	srv.Start(srv)
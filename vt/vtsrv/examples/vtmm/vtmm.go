@@ -11,7 +11,6 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"hash"
 	"os"
 	"sync"
 	"syscall"
@@ -43,9 +42,8 @@ type Vtmap struct {
 	vtsrv.Srv
 	sync.Mutex
 
-	f     *File
-	htbl  map[string][]byte
-	schan chan hash.Hash
+	f    *File
+	htbl map[vt.Score][]byte
 }
 
 var addr = flag.String("addr", ":17034", "network address")
@@ -54,8 +52,7 @@ var align = flag.Int("align", 0, "block alignment")
 
 func (srv *Vtmap) init(fname string) (err error) {
 	err = nil
-	srv.htbl = make(map[string][]byte, 1<<12)
-	srv.schan = make(chan hash.Hash, 32)
+	srv.htbl = make(map[vt.Score][]byte, 1<<12)
 	srv.f, err = NewFile(fname)
 	if err != nil {
 		return
@@ -220,7 +217,7 @@ func (srv *Vtmap) buildHash() error {
 		}
 
 		score := srv.calcScore(blk)
-		srv.htbl[string([]byte(score))] = blk
+		srv.htbl[score] = blk
 		nblk++
 		blksz += uint64(len(blk))
 	}
@@ -232,24 +229,8 @@ func (srv *Vtmap) buildHash() error {
 	return nil
 }
 
-func (srv *Vtmap) calcScore(data []byte) (ret vt.Score) {
-	var s1 hash.Hash
-
-	select {
-	default:
-		s1 = sha1.New()
-	case s1 = <-srv.schan:
-		s1.Reset()
-	}
-
-	s1.Write(data)
-	ret = s1.Sum(nil)
-	select {
-	case srv.schan <- s1:
-		break
-	default:
-	}
-	return
+func (srv *Vtmap) calcScore(data []byte) vt.Score {
+	return vt.Score(sha1.Sum(data))
 }
 
 func (srv *Vtmap) Hello(req *vtsrv.Req) {
@@ -258,12 +239,11 @@ func (srv *Vtmap) Hello(req *vtsrv.Req) {
 
 func (srv *Vtmap) Read(req *vtsrv.Req) {
 	srv.Lock()
-	strscore := string([]byte(req.Tc.Score))
-	b := srv.htbl[strscore]
+	b := srv.htbl[req.Tc.Score]
 	srv.Unlock()
 
 	if b == nil {
-		req.RespondError("not found")
+		req.RespondErr(vt.ErrNotFound)
 	} else {
 		req.RespondRead(b)
 	}
@@ -271,9 +251,8 @@ func (srv *Vtmap) Read(req *vtsrv.Req) {
 
 func (srv *Vtmap) Write(req *vtsrv.Req) {
 	score := srv.calcScore(req.Tc.Data)
-	strscore := string([]byte(score))
 	srv.Lock()
-	if srv.htbl[strscore] == nil {
+	if srv.htbl[score] == nil {
 		block, err := srv.f.WriteBlock(req.Tc.Data)
 		if err != nil {
 			srv.Unlock()
@@ -281,7 +260,7 @@ func (srv *Vtmap) Write(req *vtsrv.Req) {
 			return
 		}
 
-		srv.htbl[strscore] = block
+		srv.htbl[score] = block
 	}
 	srv.Unlock()
 	req.RespondWrite(score)
@@ -7,7 +7,6 @@ package main
 import (
 	"crypto/sha1"
 	"flag"
-	"hash"
 	"sync"
 
 	"github.com/mischief/govt/vt"
@@ -17,93 +16,44 @@ import (
 type Vtram struct {
 	vtsrv.Srv
 	sync.Mutex
-	htbl  map[int]*Block
-	schan chan hash.Hash
+	htbl map[vt.Score]*Block
 }
 
 type Block struct {
 	btype uint8
 	score vt.Score
 	data  []byte
-
-	next *Block
 }
 
 var addr = flag.String("addr", ":17034", "network address")
 var debug = flag.Int("debug", 0, "print debug messages")
 
 func (srv *Vtram) init() {
-	srv.htbl = make(map[int]*Block)
-	srv.schan = make(chan hash.Hash, 32)
-}
-
-func calcHash(score vt.Score) int {
-	return int(score[0]<<24) | int(score[1]<<16) | int(score[2]<<8) | int(score[3])
-}
-
-func (srv *Vtram) calcScore(data []byte) (ret vt.Score) {
-	var s1 hash.Hash
-
-	select {
-	default:
-		s1 = sha1.New()
-	case s1 = <-srv.schan:
-		s1.Reset()
-	}
-
-	s1.Write(data)
-	ret = s1.Sum(nil)
-	select {
-	case srv.schan <- s1:
-		break
-	default:
-	}
-	return
+	srv.htbl = make(map[vt.Score]*Block)
 }
 
-func eqscore(s1, s2 vt.Score) bool {
-	for i := 0; i < vt.Scoresize; i++ {
-		if s1[i] != s2[i] {
-			return false
-		}
-	}
-
-	return true
+func (srv *Vtram) calcScore(data []byte) vt.Score {
+	return vt.Score(sha1.Sum(data))
 }
 
 func (srv *Vtram) getBlock(score vt.Score) *Block {
-	var b *Block
-
-	h := calcHash(score)
 	srv.Lock()
-	for b = srv.htbl[h]; b != nil; b = b.next {
-		if eqscore(b.score, score) {
-			break
-		}
-	}
+	b := srv.htbl[score]
 	srv.Unlock()
 	return b
 }
 
 func (srv *Vtram) putBlock(btype uint8, data []byte) *Block {
-	var b *Block
-
 	score := srv.calcScore(data)
-	h := calcHash(score)
 
 	srv.Lock()
-	for b = srv.htbl[h]; b != nil; b = b.next {
-		if eqscore(b.score, score) {
-			break
-		}
-	}
+	b := srv.htbl[score]
 	if b == nil {
 		b = new(Block)
 		b.score = score
 		b.btype = btype
 		b.data = data
-		b.next = srv.htbl[h]
-		srv.htbl[h] = b
+		srv.htbl[score] = b
 	}
 	srv.Unlock()
 
@@ -117,7 +67,7 @@ func (srv *Vtram) Hello(req *vtsrv.Req) {
 func (srv *Vtram) Read(req *vtsrv.Req) {
 	b := srv.getBlock(req.Tc.Score)
 	if b == nil {
-		req.RespondError("not found")
+		req.RespondErr(vt.ErrNotFound)
 	} else {
 		n := int(req.Tc.Count)
 		if n > len(b.data) {
@@ -5,11 +5,13 @@
 package vtsrv
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/mischief/govt/vt"
 )
@@ -19,6 +21,10 @@ const (
 	Chello
 )
 
+// Time a new client has to complete the TLS handshake and the banner
+// exchange, unless set in the Srv.
+const DefaultBannerTimeout = 30 * time.Second
+
 const (
 	DbgPrintCalls = 1 << iota
 	DbgPrintPackets
@@ -67,6 +73,7 @@ type Conn struct {
 	Id         string
 	Debuglevel int
 	status     int
+	version    int
 	conn       net.Conn
 	reqs       *Req
 	reqout     chan *Req
@@ -91,12 +98,13 @@ type Req struct {
 
 type Srv struct {
 	sync.Mutex
-	Id         string
-	Debuglevel int
-	Log        *vt.Logger
-	ops        interface{}
-	connlist   *Conn
-	rchan      chan *Req
+	Id            string
+	Debuglevel    int
+	Log           *vt.Logger
+	BannerTimeout time.Duration // DefaultBannerTimeout if 0
+	ops           interface{}
+	connlist      *Conn
+	rchan         chan *Req
 
 	// stats
 	nreqs   int    // number of requests processed
@@ -189,6 +197,11 @@ func (req *Req) Process() {
 		conn.status = Cnew
 
 	case vt.Tread:
+		if tc.Score == vt.Zeroscore {
+			req.RespondRead(nil)
+			return
+		}
+
 		if rop, ok := (srv.ops).(ReadOp); ok {
 			rop.Read(req)
 		} else {
@@ -196,6 +209,12 @@ func (req *Req) Process() {
 		}
 
 	case vt.Twrite:
+		tc.Data = vt.ZeroTruncate(tc.Btype, tc.Data)
+		if len(tc.Data) == 0 {
+			req.RespondWrite(vt.Zeroscore)
+			return
+		}
+
 		if wop, ok := (srv.ops).(WriteOp); ok {
 			wop.Write(req)
 		} else {
@@ -235,6 +254,12 @@ func (req *Req) RespondError(ename string) {
 	req.Respond()
 }
 
+// Responds with Rerror. Errors matching one of the well-known vt errors
+// (vt.ErrNotFound, etc.) are sent with their canonical string.
+func (req *Req) RespondErr(err error) {
+	req.RespondError(vt.Ename(err))
+}
+
 func (req *Req) RespondPing() {
 	req.Rc.Id = vt.Rping
 	req.Respond()
@@ -271,9 +296,16 @@ func (conn *Conn) String() string {
 	return conn.Srv.Id + "/" + conn.Id
 }
 
+// Creates a new connection that uses version 02 of the protocol. The
+// banners should already be exchanged.
 func (srv *Srv) NewConn(c net.Conn) {
+	srv.newConn(c, vt.Version02)
+}
+
+func (srv *Srv) newConn(c net.Conn, vers int) {
 	conn := new(Conn)
 	conn.status = Cnew
+	conn.version = vers
 	conn.Srv = srv
 	conn.Debuglevel = srv.Debuglevel
 	conn.conn = c
@@ -299,83 +331,44 @@ func (srv *Srv) NewConn(c net.Conn) {
 }
 
 func (conn *Conn) recv() {
-	var err error
-	var n int
-
-	bufsz := 8 * vt.Maxblock
-	buf := make([]byte, bufsz*8)
 	srv := conn.Srv
-	pos := 0
+	dec := vt.NewDecoder(conn.conn, conn.version)
 	for {
-		if len(buf) < vt.Maxblock {
-			b := make([]byte, bufsz)
-			copy(b, buf[0:pos])
-			buf = b
-			b = nil
-		}
-
-		n, err = conn.conn.Read(buf[pos:])
-		if err != nil || n == 0 {
-			goto closed
-		}
-
-		nreads := 1
-		pos += n
-		for pos > 2 {
-			sz, _ := vt.Gint16(buf)
-			sz += 2
-			if sz > vt.Maxblock {
-				log.Println("bad client connection: ", conn.conn.RemoteAddr())
-				conn.conn.Close()
-				goto closed
-			}
-			if pos < int(sz) {
-				if len(buf) < int(sz) {
-					b := make([]byte, bufsz)
-					copy(b, buf[0:pos])
-					buf = b
-					b = nil
-				}
-
-				break
-			}
-
-			req := srv.ReqAlloc()
-			req.Conn = conn
-			csize, err := vt.Unpack(buf, req.Tc)
-			if err != nil {
-				log.Println(fmt.Sprintf("invalid packet: %v %v", err, buf))
+		req := srv.ReqAlloc()
+		req.Conn = conn
+		err := dec.Decode(req.Tc)
+		if err != nil {
+			if _, ok := err.(*vt.Error); ok {
+				log.Println(fmt.Sprintf("invalid packet: %v %v", err, conn.conn.RemoteAddr()))
 				conn.conn.Close()
-				srv.ReqFree(req)
-				goto closed
 			}
 
-			if conn.Debuglevel > 0 {
-				conn.logFcall(req.Tc)
-				if conn.Debuglevel&DbgPrintPackets != 0 {
-					log.Println(">->", conn.Id, fmt.Sprintf("%x", req.Tc.Pkt))
-				}
+			srv.ReqFree(req)
+			goto closed
+		}
 
-				if conn.Debuglevel&DbgPrintCalls != 0 {
-					log.Println(">>>", conn.Id, req.Tc.String())
-				}
+		if conn.Debuglevel > 0 {
+			conn.logFcall(req.Tc)
+			if conn.Debuglevel&DbgPrintPackets != 0 {
+				log.Println(">->", conn.Id, fmt.Sprintf("%x", req.Tc.Pkt))
 			}
 
-			conn.Lock()
-			conn.nreqs++
-			conn.tsz += uint64(sz)
-			conn.npend++
-			conn.nreads += nreads
-			nreads = 0
-			if conn.npend > conn.maxpend {
-				conn.maxpend = conn.npend
+			if conn.Debuglevel&DbgPrintCalls != 0 {
+				log.Println(">>>", conn.Id, req.Tc.String())
 			}
-			conn.Unlock()
+		}
 
-			go req.process()
-			buf = buf[csize:]
-			pos -= csize
+		conn.Lock()
+		conn.nreqs++
+		conn.tsz += uint64(len(req.Tc.Pkt))
+		conn.npend++
+		conn.nreads = dec.Nreads()
+		if conn.npend > conn.maxpend {
+			conn.maxpend = conn.npend
 		}
+		conn.Unlock()
+
+		go req.process()
 	}
 
 closed:
@@ -407,21 +400,28 @@ closed:
 }
 
 func (conn *Conn) send() {
-	buf := make([]byte, 8*vt.Maxblock)
-	pos := 0
-
+	enc := vt.NewEncoder(conn.conn, conn.version)
 	for {
 		select {
 		case <-conn.done:
 			return
 
 		case req := <-conn.reqout:
-		again:
+			var err error
+
 			nreqs := 0
+			size := 0
 			for req != nil {
 				req.Rc.Tag = req.Tc.Tag
-				n := vt.Pack(buf[pos:], req.Rc)
-				if n < 0 {
+				err = enc.Encode(req.Rc)
+				if err == vt.Epacket {
+					// the response can't be packed, send an error instead
+					req.Rc.Id = vt.Rerror
+					req.Rc.Ename = err.Error()
+					err = enc.Encode(req.Rc)
+				}
+
+				if err != nil {
 					break
 				}
 
@@ -436,7 +436,7 @@ func (conn *Conn) send() {
 					}
 				}
 
-				pos += n
+				size += len(req.Rc.Pkt)
 				nreqs++
 				conn.Srv.ReqFree(req)
 				select {
@@ -446,36 +446,61 @@ func (conn *Conn) send() {
 				}
 			}
 
-			nwrites := 0
-			for b := buf[0:pos]; len(b) > 0; {
-				n, err := conn.conn.Write(b)
-				if err != nil {
-					/* just close the socket, will get signal on conn.done */
-					log.Println("error while writing")
-					conn.conn.Close()
-					break
-				}
-				nwrites++
-				b = b[n:]
+			if err == nil {
+				err = enc.Flush()
+			}
+
+			if err != nil {
+				/* just close the socket, will get signal on conn.done */
+				log.Println("error while writing")
+				conn.conn.Close()
 			}
 
 			conn.Lock()
-			conn.rsz += uint64(pos)
+			conn.rsz += uint64(size)
 			conn.npend -= nreqs
-			conn.nwrites += nwrites
+			conn.nwrites = enc.Nwrites()
 			conn.Unlock()
-			pos = 0
-			if req != nil {
-				goto again
-			}
 		}
 	}
 }
 
+// Returns the protocol version used by the connection.
+func (conn *Conn) Version() int {
+	return conn.version
+}
+
 func (conn *Conn) RemoteAddr() net.Addr {
 	return conn.conn.RemoteAddr()
 }
 
+// Returns the certificate the client presented over TLS, or nil if
+// the connection doesn't use TLS or the client sent no certificate.
+func (conn *Conn) PeerCertificate() *x509.Certificate {
+	tc, ok := conn.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+
+	return certs[0]
+}
+
+// Returns the subject of the client's TLS certificate, or "" if there
+// is none. Hello handlers can use it to identify the user.
+func (conn *Conn) Subject() string {
+	cert := conn.PeerCertificate()
+	if cert == nil {
+		return ""
+	}
+
+	return cert.Subject.String()
+}
+
 func (conn *Conn) LocalAddr() net.Addr {
 	return conn.conn.LocalAddr()
 }
@@ -498,7 +523,7 @@ func (conn *Conn) logFcall(c *vt.Call) {
 func StartListener(network, laddr string, srv *Srv) error {
 	l, err := net.Listen(network, laddr)
 	if err != nil {
-		log.Println("listen fail: ", network, listen, err)
+		log.Println("listen fail: ", network, laddr, err)
 		return err
 	}
 
@@ -506,45 +531,18 @@ func StartListener(network, laddr string, srv *Srv) error {
 	return nil
 }
 
-func checkBanner(c net.Conn) bool {
-	var i int
-	bhdr := "venti-"
-	bver := "02"
-
-	buf := make([]byte, len(bhdr)+len(bver)+3)
-	n, err := c.Read(buf[0:len(bhdr)])
-	if err != nil || n != len(bhdr) || string(buf[0:n]) != bhdr {
-		return false
-	}
-
-	// read the versions
-	for i = 0; i < len(buf)-1; i++ {
-		n, err = c.Read(buf[i : i+1])
-		if buf[i] == '-' {
-			break
-		}
-	}
-
-	// read the rest
-	for {
-		n, err = c.Read(buf[i : i+1])
-		if err != nil || n != 1 {
-			return false
-		}
-
-		if buf[i] == '\n' {
-			break
-		}
-	}
-
-	vers := strings.SplitN(string(buf[0:i]), ":", -1)
-	for i = 0; i < len(vers); i++ {
-		if vers[i] == bver {
-			return true
-		}
+// Like StartListener, but the connections are secured with TLS. The
+// config should contain the server's certificate. To require client
+// certificates, set its ClientAuth and ClientCAs.
+func StartTLSListener(network, laddr string, srv *Srv, config *tls.Config) error {
+	l, err := tls.Listen(network, laddr, config)
+	if err != nil {
+		log.Println("listen fail: ", network, laddr, err)
+		return err
 	}
 
-	return false
+	listen(l, srv)
+	return nil
 }
 
 func listen(l net.Listener, srv *Srv) {
@@ -554,27 +552,45 @@ func listen(l net.Listener, srv *Srv) {
 			break
 		}
 
-		if !processBanner(c) {
-			c.Close()
-		}
+		// a silent client must not hold up the others
+		go srv.accept(c)
+	}
+}
 
-		srv.NewConn(c)
+// Exchanges banners with a new client and starts serving it. With TLS,
+// the handshake is done by the first write of the banner.
+func (srv *Srv) accept(c net.Conn) {
+	d := srv.BannerTimeout
+	if d == 0 {
+		d = DefaultBannerTimeout
 	}
+
+	c.SetDeadline(time.Now().Add(d))
+	vers := processBanner(c)
+	if vers == 0 {
+		c.Close()
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+	srv.newConn(c, vers)
 }
 
-func processBanner(c net.Conn) bool {
+// Exchanges banners with the client. Returns the highest protocol
+// version supported by both sides, or 0 if there is none.
+func processBanner(c net.Conn) int {
 	var i int
 
 	n, err := c.Write([]byte(vt.Banner))
 	if err != nil || n != len(vt.Banner) {
-		return false
+		return 0
 	}
 
 	buf := make([]byte, 1024)
 	for i = 0; i < len(buf); i++ {
 		n, err := c.Read(buf[i : i+1])
 		if err != nil || n != 1 {
-			return false
+			return 0
 		}
 
 		if buf[i] == '\n' {
@@ -582,5 +598,5 @@ func processBanner(c net.Conn) bool {
 		}
 	}
 
-	return vt.CheckBanner(string(buf[0:i]))
+	return vt.BannerVersion(string(buf[0:i]))
 }
@@ -0,0 +1,85 @@
+// Copyright 2010 The Govt Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vt
+
+// Depth of the block type, 0 for data and directory blocks
+const Depthmask = 7
+
+// Returns true if blocks of the specified type are zero-extended to
+// the requested size when read. Only pointer blocks are, the size of
+// the data in data and directory blocks is not known to the client.
+func Extendable(btype uint8) bool {
+	return btype != RBlock && btype&Depthmask != 0
+}
+
+// Returns the size to which a block of n bytes read with the specified
+// count is zero-extended. Pointer blocks are extended to count bytes,
+// directory blocks to a whole number of entries, but not beyond count.
+// Other blocks are not extended.
+func ExtendSize(btype uint8, n, count int) int {
+	switch {
+	case Extendable(btype):
+		n = count
+	case btype == DirBlock && n%Entrysize != 0:
+		n += Entrysize - n%Entrysize
+		if n > count {
+			n = count
+		}
+	}
+
+	return n
+}
+
+// Removes the trailing zeros from the block. Pointer blocks are truncated
+// to the last score that is not Zeroscore. Root blocks are not truncated.
+func ZeroTruncate(btype uint8, buf []byte) []byte {
+	if btype == RBlock {
+		return buf
+	}
+
+	n := len(buf)
+	if btype&Depthmask == 0 {
+		for n > 0 && buf[n-1] == 0 {
+			n--
+		}
+	} else {
+		for n >= Scoresize && Score(buf[n-Scoresize:n]) == Zeroscore {
+			n -= Scoresize
+		}
+	}
+
+	return buf[0:n]
+}
+
+// Extends the block to the specified size, reversing the effect of
+// ZeroTruncate. Pointer blocks are padded with Zeroscore, other blocks
+// with zeros. If the buffer's capacity is big enough, it is extended in
+// place.
+func ZeroExtend(btype uint8, buf []byte, size int) []byte {
+	n := len(buf)
+	if n >= size {
+		return buf
+	}
+
+	if cap(buf) < size {
+		b := make([]byte, size)
+		copy(b, buf)
+		buf = b
+	} else {
+		buf = buf[0:size]
+	}
+
+	if Extendable(btype) {
+		for n = n / Scoresize * Scoresize; n+Scoresize <= size; n += Scoresize {
+			copy(buf[n:], Zeroscore[:])
+		}
+	}
+
+	for ; n < size; n++ {
+		buf[n] = 0
+	}
+
+	return buf
+}